@@ -1,48 +1,98 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 type ClientId string
 
+// A client connected to one of the devices, see clients.go
 type ConnectedClient struct {
-	ClientId            ClientId
-	ClientTransactionID uint32
-	Connected           bool
+	ClientId            ClientId  `json:"ClientID"`
+	Device              string    `json:"Device"` // e.g. "switch/0"
+	Address             string    `json:"Address"`
+	ClientTransactionID uint32    `json:"ClientTransactionID"` // of the last transaction
+	LastTransaction     time.Time `json:"LastTransaction"`
+	Connected           bool      `json:"Connected"`
+	hub                 int
 }
 
 type ApiServer struct {
 	ApiPort             uint32
 	ServerTransactionID uint32
+	Discovery           *DiscoveryServer // checked by /readyz
+	server              *http.Server
 }
 
 func NewApiServer(apiPort uint32) *ApiServer {
-	return &ApiServer{
+	srv := &ApiServer{
 		ApiPort: apiPort,
 	}
-}
-
-func (srv *ApiServer) Start() {
-
 	router := httprouter.New()
 	srv.configureManagementAPI(router)
 	srv.configureCommonAPI(router)
 	srv.configureSwitchAPI(router)
 	srv.configureFocuserAPI(router)
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", srv.ApiPort), router))
+	// Built here rather than in Start so that Shutdown, called from another goroutine, never
+	// sees it half set up
+	srv.server = &http.Server{
+		Addr:    fmt.Sprintf("0.0.0.0:%d", srv.ApiPort),
+		Handler: metricsAlpacaRequests(router),
+	}
+	return srv
+}
 
+func (srv *ApiServer) Start() {
+	err := srv.server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
 }
 
-func (srv *ApiServer) handleNotSupported(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// Stop accepting new requests and wait for in-flight requests to finish. Start returns once
+// Shutdown has been called, even if it had not started listening yet.
+func (srv *ApiServer) Shutdown(ctx context.Context) error {
+	return srv.server.Shutdown(ctx)
+}
+
+// Handles a request to one hub, hub is its position in settings.json
+type hubHandle func(w http.ResponseWriter, r *http.Request, hub int)
+
+// Route a request for a device to the hub serving it, looked up in the device table by the
+// device_number in the path. An unknown device number is a 400 error as the Alpaca API requires.
+func (srv *ApiServer) device(deviceType string, handle hubHandle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		number, err := strconv.ParseUint(ps.ByName("device_number"), 10, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid device number %q", ps.ByName("device_number")), http.StatusBadRequest)
+			return
+		}
+		hub, ok := MhpFindDevice(deviceType, uint32(number))
+		if !ok {
+			http.Error(w, fmt.Sprintf("no %s with device number %d", strings.ToLower(deviceType), number), http.StatusBadRequest)
+			return
+		}
+		if err := checkAlpacaRequest(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		clientSeen(r, deviceType, hub)
+		handle(w, r, hub)
+	}
+}
+
+func (srv *ApiServer) handleNotSupported(w http.ResponseWriter, r *http.Request, _ int) {
 	resp := stringResponse{
 		Value: "Command not supported",
 	}
@@ -54,110 +104,26 @@ func (srv *ApiServer) handleNotSupported(w http.ResponseWriter, r *http.Request,
 }
 
 func (srv *ApiServer) prepareAlpacaResponse(r *http.Request, resp *alpacaResponse) {
-	ctid := getClientTransactionId(r)
-	if ctid < 0 {
-		ctid = 0
-	}
 	srv.ServerTransactionID += 1
-	resp.ClientTransactionID = uint32(ctid)
+	resp.ClientTransactionID = getClientTransactionId(r)
 	resp.ServerTransactionID = srv.ServerTransactionID
-
-}
-
-func (srv *ApiServer) validAlpacaRequest(r *http.Request) bool {
-	//if _, err := strconv.Atoi(c.Param("device_id")); err != nil {
-	//	return false
-	//}
-	cid := getClientId(r)
-	if cid < 0 {
-		return false
-	}
-
-	ctidv := getClientTransactionId(r)
-	return ctidv >= 0
-}
-
-func getClientId(r *http.Request) int {
-	cidv := ""
-	if r.Method == "GET" {
-		cidv = r.URL.Query().Get("ClientID")
-		if cidv == "" {
-			cidv = r.URL.Query().Get("clientid")
-			if cidv == "" {
-				return -1
-			}
-		}
-	} else {
-		cidv = r.PostFormValue("ClientID")
-		if cidv == "" {
-			cidv = r.PostFormValue("clientid")
-			if cidv == "" {
-				return -1
-			}
-		}
-	}
-	cid, err := strconv.Atoi(cidv)
-	if err != nil {
-		return -1
-	}
-	if cid < 0 {
-		return -1
-	}
-	return cid
-}
-
-func getClientTransactionId(r *http.Request) int {
-	ctidv := ""
-	if r.Method == "GET" {
-		ctidv = r.URL.Query().Get("ClientTransactionID")
-		if ctidv == "" {
-			ctidv = r.URL.Query().Get("clienttransactionid")
-			if ctidv == "" {
-				return -1
-			}
-		}
-	} else { // PUT
-		ctidv = r.PostFormValue("ClientTransactionID")
-		if ctidv == "" {
-			ctidv = r.PostFormValue("clienttransactionid")
-			if ctidv == "" {
-				return -1
-			}
-		}
-	}
-	ctid, err := strconv.Atoi(ctidv)
-	if err != nil {
-		return -1
-	}
-	if ctid < 0 {
-		return -1
-	}
-	return ctid
+	metricsAlpacaRequest(r, resp.ErrorNumber)
 }
 
 func getIdFromRequest(r *http.Request) (result int32, err error) {
-	sid := ""
-	if r.Method == "GET" {
-		sid = r.URL.Query().Get("Id")
-		if sid == "" {
-			return -1, errors.New("id parameter missing")
-		}
-	} else { // i.e. PUT command
-		//sid = c.Request.FormValue("Id")
-		sid = r.PostFormValue("Id")
-		if sid == "" {
-			return -1, errors.New("id parameter missing")
-		}
+	sid := alpacaParam(r, "Id")
+	if sid == "" {
+		return -1, errors.New("id parameter missing")
 	}
 
 	iid, err := strconv.ParseInt(sid, 10, 32)
 	if err != nil {
 		return -1, errors.New("id parameter not numeric")
 	}
-	result = int32(iid)
-	if result < 0 {
+	if iid < 0 || iid >= NumSwitches {
 		return -1, errors.New("id parameter out of range")
 	}
+	result = int32(iid)
 
 	result += 1 // offset for shared device
 
@@ -165,16 +131,13 @@ func getIdFromRequest(r *http.Request) (result int32, err error) {
 }
 
 func getValueFromRequest(r *http.Request) (result int64, err error) {
-	svalue := ""
-	if r.Method == "PUT" {
-		// svalue = c.Request.FormValue("Value")
-		svalue = r.PostFormValue("Value")
-		if svalue == "" {
-			return -1, errors.New("value parameter missing")
-		}
-	} else {
+	if r.Method != "PUT" {
 		return -1, errors.New("expected PUT")
 	}
+	svalue := alpacaParam(r, "Value")
+	if svalue == "" {
+		return -1, errors.New("value parameter missing")
+	}
 	ivalue, err := strconv.ParseInt(svalue, 10, 64)
 	if err != nil {
 		return -1, errors.New("value parameter not numeric")
@@ -188,13 +151,11 @@ func getValueFromRequest(r *http.Request) (result int64, err error) {
 }
 
 func getPositionFromRequest(r *http.Request) (result int32, err error) {
-	sposition := ""
 	if r.Method != "PUT" {
 		return -1, errors.New("expected PUT")
 	}
 
-	// svalue = c.Request.FormValue("Value")
-	sposition = r.PostFormValue("Position")
+	sposition := alpacaParam(r, "Position")
 	if sposition == "" {
 		return -1, errors.New("position parameter missing")
 	}
@@ -211,19 +172,10 @@ func getPositionFromRequest(r *http.Request) (result int32, err error) {
 }
 
 func getSwitchStateFromRequest(r *http.Request) (bstate bool, err error) {
-	sstate := ""
-	if r.Method == "GET" {
-		sstate = r.URL.Query().Get("State")
-		if sstate == "" {
-			err = errors.New("state parameter missing")
-			return
-		}
-	} else { // e.g PUT command
-		sstate = r.PostFormValue("State")
-		if sstate == "" {
-			err = errors.New("state parameter missing")
-			return
-		}
+	sstate := alpacaParam(r, "State")
+	if sstate == "" {
+		err = errors.New("state parameter missing")
+		return
 	}
 	bstate, err = strconv.ParseBool(sstate)
 	if err != nil {
@@ -233,25 +185,28 @@ func getSwitchStateFromRequest(r *http.Request) (bstate bool, err error) {
 }
 
 func getSwitchNameFromRequest(r *http.Request) (sname string, err error) {
-	if r.Method == "GET" {
-		sname = r.URL.Query().Get("Name")
-		if sname == "" {
-			err = errors.New("name parameter missing")
-			return
-		}
-	} else { // e.g PUT command
-		sname = r.PostFormValue("Name")
-		if sname == "" {
-			err = errors.New("name parameter missing")
-			return
-		}
+	sname = alpacaParam(r, "Name")
+	if sname == "" {
+		err = errors.New("name parameter missing")
+		return
+	}
+	return
+}
+
+func getActionFromRequest(r *http.Request) (action string, parameters string, err error) {
+	// PUT command
+	action = alpacaParam(r, "Action")
+	if action == "" {
+		err = errors.New("action parameter missing")
+		return
 	}
+	parameters = alpacaParam(r, "Parameters")
 	return
 }
 
 func getConnectedFromRequest(r *http.Request) (connect bool, err error) {
 	// PUT command
-	connect, err = strconv.ParseBool(r.PostFormValue("Connected"))
+	connect, err = strconv.ParseBool(alpacaParam(r, "Connected"))
 	if err != nil {
 		err = errors.New("connected parameter missing")
 		return
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Audit log of every command sent to the hub, with who asked for it, and of the confirmations of
+// critical channels. One json object per line is appended to audit.jsonl; entries are never
+// rewritten. The log can be read back over HTTP, filtered by time, as json or csv.
+
+const auditFile = "audit.jsonl"
+
+// Where a change comes from
+const (
+	SourceAlpaca      = "alpaca"
+	SourceCommandLine = "command line"
+	SourceBoot        = "boot sequence"
+	SourceSchedule    = "schedule"
+	SourceDewSchedule = "dew schedule"
+	SourceDewControl  = "dew control"
+	SourceStartup     = "startup"
+	SourceShutdown    = "shutdown"
+	SourceReload      = "settings reload"
+	SourceProfile     = "profile"
+)
+
+// Who asked for a change. Changes from remote clients carry their ClientID and address.
+type changeOrigin struct {
+	Source   string
+	ClientID uint32
+	Address  string // host of the client, without the port
+	Token    string // confirms turning off a critical channel, see critical.go
+}
+
+func alpacaOrigin(r *http.Request) changeOrigin {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return changeOrigin{Source: SourceAlpaca, ClientID: getClientId(r), Address: host}
+}
+
+func localOrigin(source string) changeOrigin {
+	return changeOrigin{Source: source}
+}
+
+// Report whether the change comes from a client over the network rather than from the driver itself
+func (o changeOrigin) remote() bool {
+	return o.Address != ""
+}
+
+// Identifies the client for confirmations: the same ClientID from the same host over the same
+// protocol
+func (o changeOrigin) client() string {
+	return o.Source + "/" + o.Address + "/" + strconv.FormatUint(uint64(o.ClientID), 10)
+}
+
+// Report whether the client can be told apart from others on its host, so that it can confirm a
+// change by repeating it. Clients without a ClientID must confirm with the token.
+func (o changeOrigin) canRepeat() bool {
+	return o.ClientID != 0
+}
+
+// Audit events
+const (
+	AuditSent      = "sent"      // a command was sent to the hub, error is set if it failed
+	AuditRequested = "requested" // turning off a critical channel is waiting for confirmation
+	AuditConfirmed = "confirmed" // and was confirmed
+	AuditRefused   = "refused"   // a confirmation did not match
+)
+
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Hub      int       `json:"hub"`
+	Channel  int32     `json:"channel"` // switch number from settings.json, 0 for the focuser
+	Name     string    `json:"name"`
+	Old      int64     `json:"old"` // value, or position for the focuser
+	New      int64     `json:"new"`
+	Delta    int64     `json:"delta,omitempty"` // focuser steps, negative for in
+	Source   string    `json:"source"`
+	ClientID uint32    `json:"clientid,omitempty"`
+	Address  string    `json:"address,omitempty"`
+	Payload  string    `json:"payload,omitempty"` // HID report sent, in hex
+	Error    string    `json:"error,omitempty"`
+}
+
+var auditMutex sync.Mutex
+
+// Append an entry to the audit log. A failure is logged, it does not stop the change.
+func auditRecord(e auditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(&e)
+	if err != nil {
+		log.Println("Unable to write the audit log:", err)
+		return
+	}
+	data = append(data, '\n')
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	f, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Println("Unable to write the audit log:", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		log.Println("Unable to write the audit log:", err)
+		return
+	}
+	if err := f.Sync(); err != nil {
+		log.Println("Unable to write the audit log:", err)
+	}
+}
+
+func (s *sw) auditEntry(event string, id int32, old int64, new int64, o changeOrigin) auditEntry {
+	return auditEntry{
+		Event:    event,
+		Hub:      s.number(),
+		Channel:  id,
+		Name:     s.getname(id),
+		Old:      old,
+		New:      new,
+		Source:   o.Source,
+		ClientID: o.ClientID,
+		Address:  o.Address,
+	}
+}
+
+// Which entries to read back from the audit log. Zero times and a negative hub match everything.
+type auditFilter struct {
+	From time.Time
+	To   time.Time
+	Hub  int
+}
+
+func (f auditFilter) matches(e *auditEntry) bool {
+	return (f.From.IsZero() || !e.Time.Before(f.From)) &&
+		(f.To.IsZero() || e.Time.Before(f.To)) &&
+		(f.Hub < 0 || e.Hub == f.Hub)
+}
+
+// Read the entries of the audit log matching the filter, oldest first
+func readAudit(f auditFilter) ([]auditEntry, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	file, err := os.Open(auditFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A line cut short by a crash, the rest of the log is still good
+			log.Printf("%s:%d: skipped: %v", auditFile, line, err)
+			continue
+		}
+		if f.matches(&e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+var auditCSVHeader = []string{"time", "event", "hub", "channel", "name", "old", "new", "delta", "source", "clientid", "address", "payload", "error"}
+
+func writeAuditCSV(w io.Writer, entries []auditEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write(auditCSVHeader)
+	for _, e := range entries {
+		clientID := ""
+		if e.ClientID != 0 {
+			clientID = strconv.FormatUint(uint64(e.ClientID), 10)
+		}
+		cw.Write([]string{
+			e.Time.Format(time.RFC3339Nano),
+			e.Event,
+			strconv.Itoa(e.Hub),
+			strconv.Itoa(int(e.Channel)),
+			e.Name,
+			strconv.FormatInt(e.Old, 10),
+			strconv.FormatInt(e.New, 10),
+			strconv.FormatInt(e.Delta, 10),
+			e.Source,
+			clientID,
+			e.Address,
+			e.Payload,
+			e.Error,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Parse a from or to time given as RFC 3339, e.g. 2026-03-14T22:00:00+11:00, or as a local date, e.g. 2026-03-14
+func parseAuditTime(name string, v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, v, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%s must be a time such as 2026-03-14T22:00:00+11:00 or a date such as 2026-03-14, found %q", name, v)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Boot sequencing: bring switches up in a configured order with delays between them,
+// for example so that USB hubs behind the power ports have time to enumerate.
+
+type bootStep struct {
+	Id    int32 `json:"id"`    // switch number as used in settings.json, 1 to 12
+	Value int64 `json:"value"` // 0 or 1 for the power ports, 0 to 100 for the dew heaters
+	Delay int32 `json:"delay"` // seconds to wait after this step
+}
+
+var bootMutex sync.Mutex
+var bootRunning sync.WaitGroup // boot sequences in progress, waited for by MhpShutdown
+
+// Run the boot sequence of a hub in the background. Only one sequence per hub can run at a time.
+func MhpStartBootSequence(ctx context.Context, hub int) error {
+	if err := checkHub(hub); err != nil {
+		return err
+	}
+	h := hubs[hub]
+	sm.Lock()
+	steps := append([]bootStep(nil), h.Bootsequence...)
+	sm.Unlock()
+	if len(steps) == 0 {
+		return errors.New("no boot sequence configured")
+	}
+
+	bootMutex.Lock()
+	defer bootMutex.Unlock()
+	if h.bootCancel != nil {
+		return errors.New("boot sequence already running")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	h.bootCancel = cancel
+
+	bootRunning.Add(1)
+	go func() {
+		defer bootRunning.Done()
+		defer func() {
+			bootMutex.Lock()
+			cancel()
+			h.bootCancel = nil
+			bootMutex.Unlock()
+		}()
+		runBootSequence(ctx, hub, steps)
+	}()
+	return nil
+}
+
+// Stop a running boot sequence after its current step
+func MhpStopBootSequence(hub int) {
+	bootMutex.Lock()
+	defer bootMutex.Unlock()
+	if h := hubs[hub]; h.bootCancel != nil {
+		h.bootCancel()
+	}
+}
+
+func runBootSequence(ctx context.Context, hub int, steps []bootStep) {
+	if !hubs[hub].waitForHub(ctx) {
+		return
+	}
+	log.Println("Starting boot sequence of hub", hub, "with", len(steps), "steps")
+	for i, step := range steps {
+		if ctx.Err() != nil {
+			log.Println("Boot sequence of hub", hub, "stopped")
+			return
+		}
+		var err error
+		if step.Id >= 1 && step.Id <= NumOnOffSwitch {
+			err = MhpSetOnOff(hub, step.Id, step.Value != 0, localOrigin(SourceBoot))
+		} else {
+			err = MhpSetValue(hub, step.Id, step.Value, localOrigin(SourceBoot))
+		}
+		if err != nil {
+			log.Println("Boot sequence step", i+1, "failed:", err)
+		} else {
+			log.Println("Boot sequence step", i+1, ":", MhpGetName(hub, step.Id), "set to", step.Value)
+		}
+		if step.Delay > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(step.Delay) * time.Second):
+			}
+		}
+	}
+	log.Println("Boot sequence of hub", hub, "finished")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Minimal Alpaca REST client used by the command line to control a running mhp server.
+
+const cliClientID = 4242
+
+type AlpacaClient struct {
+	BaseURL       string
+	HTTP          http.Client
+	transactionID uint32
+}
+
+func NewAlpacaClient(server string) *AlpacaClient {
+	if !strings.HasPrefix(server, "http://") && !strings.HasPrefix(server, "https://") {
+		server = "http://" + server
+	}
+	return &AlpacaClient{
+		BaseURL: strings.TrimRight(server, "/"),
+		HTTP:    http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Get calls an Alpaca GET method on a device and decodes the response into resp
+func (c *AlpacaClient) Get(device string, method string, params url.Values, resp any) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	c.addTransaction(params)
+	u := fmt.Sprintf("%s/api/v1/%s/%s?%s", c.BaseURL, device, method, params.Encode())
+	r, err := c.HTTP.Get(u)
+	if err != nil {
+		return err
+	}
+	return decodeAlpacaResponse(r, resp)
+}
+
+// Put calls an Alpaca PUT method on a device with form encoded parameters
+func (c *AlpacaClient) Put(device string, method string, params url.Values) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	c.addTransaction(params)
+	u := fmt.Sprintf("%s/api/v1/%s/%s", c.BaseURL, device, method)
+	req, err := http.NewRequest(http.MethodPut, u, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	var resp putResponse
+	return decodeAlpacaResponse(r, &resp)
+}
+
+func (c *AlpacaClient) addTransaction(params url.Values) {
+	c.transactionID++
+	params.Set("ClientID", fmt.Sprint(cliClientID))
+	params.Set("ClientTransactionID", fmt.Sprint(c.transactionID))
+}
+
+func decodeAlpacaResponse(r *http.Response, resp any) error {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK {
+		// The server reports most request errors as a JSON string value
+		var sresp stringResponse
+		if json.Unmarshal(body, &sresp) == nil && sresp.Value != "" {
+			return errors.New(sresp.Value)
+		}
+		return fmt.Errorf("%s: %s", r.Status, strings.TrimSpace(string(body)))
+	}
+	var aresp alpacaResponse
+	if err := json.Unmarshal(body, &aresp); err != nil {
+		return err
+	}
+	if aresp.ErrorNumber != 0 {
+		return fmt.Errorf("alpaca error 0x%x: %s", aresp.ErrorNumber, aresp.ErrorMessage)
+	}
+	return json.Unmarshal(body, resp)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connections of Alpaca clients. Each client connects to each device on its own, identified by
+// the ClientID it sends, so one client disconnecting leaves the others connected. A hub counts as
+// connected, and its USB link is kept open, while any client is connected to its switch or focuser.
+// Clients that send no ClientID are told apart by their address. A client that makes no request
+// for clientTimeout is taken to have gone away without disconnecting, e.g. after a crash.
+
+const clientTimeout = 10 * time.Minute
+const clientExpiryInterval = time.Minute
+
+var clients struct {
+	sync.Mutex
+	connected map[clientKey]*ConnectedClient
+	// Held from working out whether a hub is in use until it has been connected or
+	// disconnected, so that a connect and a disconnect cannot cross
+	hubs sync.Mutex
+}
+
+type clientKey struct {
+	device  string
+	id      ClientId
+	address string // host of a client without a ClientID, "" for the others
+}
+
+// Name of a device as used in Alpaca URLs, e.g. "switch/0"
+func deviceName(deviceType string, hub int) string {
+	return fmt.Sprintf("%s/%d", strings.ToLower(deviceType), hub)
+}
+
+func requestClient(r *http.Request) ClientId {
+	return ClientId(fmt.Sprint(getClientId(r)))
+}
+
+// The client making a request to a device
+func requestKey(r *http.Request, deviceType string, hub int) clientKey {
+	key := clientKey{device: deviceName(deviceType, hub), id: requestClient(r)}
+	if getClientId(r) == 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		key.address = host
+	}
+	return key
+}
+
+// Connect or disconnect the client making the request. The hub is connected by its first
+// client and disconnected when its last client goes.
+func setClientConnected(r *http.Request, deviceType string, hub int, connect bool) {
+	key := requestKey(r, deviceType, hub)
+
+	clients.hubs.Lock()
+	defer clients.hubs.Unlock()
+	clients.Lock()
+	if clients.connected == nil {
+		clients.connected = make(map[clientKey]*ConnectedClient)
+	}
+	if connect {
+		c, ok := clients.connected[key]
+		if !ok {
+			c = &ConnectedClient{ClientId: key.id, Device: key.device, hub: hub}
+			clients.connected[key] = c
+		}
+		c.Connected = true
+		c.Address = r.RemoteAddr
+		c.ClientTransactionID = getClientTransactionId(r)
+		c.LastTransaction = time.Now()
+	} else {
+		delete(clients.connected, key)
+	}
+	clients.Unlock()
+	updateHubConnection(hub)
+}
+
+// Connect the hub if any client is connected to it and disconnect it if none is. Caller holds
+// clients.hubs.
+func updateHubConnection(hub int) {
+	clients.Lock()
+	inUse := false
+	for _, c := range clients.connected {
+		if c.hub == hub {
+			inUse = true
+			break
+		}
+	}
+	clients.Unlock()
+
+	if inUse != MhpGetConnected(hub) {
+		MhpSetConnect(hub, inUse)
+	}
+}
+
+// Disconnect clients that have made no request for clientTimeout, until ctx is cancelled
+func MhpExpireClients(ctx context.Context) {
+	ticker := time.NewTicker(clientExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		expireClients(time.Now().Add(-clientTimeout))
+	}
+}
+
+// Disconnect the clients whose last transaction was before cutoff
+func expireClients(cutoff time.Time) {
+	clients.hubs.Lock()
+	defer clients.hubs.Unlock()
+	clients.Lock()
+	expired := make(map[int]bool)
+	for key, c := range clients.connected {
+		if c.LastTransaction.Before(cutoff) {
+			log.Printf("Client %s at %s made no request since %s, disconnecting it from %s",
+				c.ClientId, c.Address, c.LastTransaction.Format(time.DateTime), c.Device)
+			delete(clients.connected, key)
+			expired[c.hub] = true
+		}
+	}
+	clients.Unlock()
+	for hub := range expired {
+		updateHubConnection(hub)
+	}
+}
+
+// Report whether the client making the request is connected to the device
+func clientConnected(r *http.Request, deviceType string, hub int) bool {
+	key := requestKey(r, deviceType, hub)
+	clients.Lock()
+	defer clients.Unlock()
+	_, ok := clients.connected[key]
+	return ok
+}
+
+// Record a transaction from a connected client
+func clientSeen(r *http.Request, deviceType string, hub int) {
+	key := requestKey(r, deviceType, hub)
+	clients.Lock()
+	defer clients.Unlock()
+	if c, ok := clients.connected[key]; ok {
+		c.Address = r.RemoteAddr
+		c.ClientTransactionID = getClientTransactionId(r)
+		c.LastTransaction = time.Now()
+	}
+}
+
+// The connected clients, ordered by device, ClientID and then address
+func connectedClients() []ConnectedClient {
+	clients.Lock()
+	defer clients.Unlock()
+	list := []ConnectedClient{}
+	for _, c := range clients.connected {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Device != list[j].Device {
+			return list[i].Device < list[j].Device
+		}
+		if list[i].ClientId != list[j].ClientId {
+			return list[i].ClientId < list[j].ClientId
+		}
+		return list[i].Address < list[j].Address
+	})
+	return list
+}
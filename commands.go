@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Subcommands of the mhp executable. With no arguments the program runs the Alpaca server.
+
+func runCommand(args []string) int {
+	switch args[0] {
+	case "discover":
+		return runDiscover(args[1:])
+	case "switch":
+		return runSwitch(args[1:])
+	case "dew":
+		return runDew(args[1:])
+	case "focuser":
+		return runFocuser(args[1:])
+	case "status":
+		return runStatus(args[1:])
+	case "config":
+		return runConfig(args[1:])
+	case "profile":
+		return runProfile(args[1:])
+	case "hubs":
+		return runHubs(args[1:])
+	case "help", "-h", "-help", "--help":
+		printUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		printUsage()
+		return 2
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  mhp                 run the Alpaca server")
+	fmt.Fprintln(os.Stderr, "  mhp discover        list Alpaca servers and devices on the network")
+	fmt.Fprintln(os.Stderr, "  mhp switch set <1-8> <on|off>")
+	fmt.Fprintln(os.Stderr, "  mhp dew set <1-4> <0-100>")
+	fmt.Fprintln(os.Stderr, "  mhp focuser move <position>")
+	fmt.Fprintln(os.Stderr, "  mhp status")
+	fmt.Fprintln(os.Stderr, "  mhp hubs            list the Mount Hub Pro units plugged in to this computer")
+	fmt.Fprintln(os.Stderr, "  mhp config check [-file settings.json]")
+	fmt.Fprintln(os.Stderr, "  mhp profile list")
+	fmt.Fprintln(os.Stderr, "  mhp profile save|use|delete <name> [-hub n]")
+	fmt.Fprintln(os.Stderr, "  mhp profile export <name> <file.json|file.yaml>")
+	fmt.Fprintln(os.Stderr, "  mhp profile import <file.json|file.yaml> <name>")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "The switch, dew, focuser and status commands talk to the hub directly over USB,")
+	fmt.Fprintln(os.Stderr, "or to a running mhp server when -server host:port is given. With more than one hub")
+	fmt.Fprintln(os.Stderr, "in settings.json, -hub n selects the hub, numbered from 0 in the order they are listed.")
+}
+
+// Parse flags that may appear before, between or after the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// Flags shared by the commands that control the hub
+func newControlFlags(name string) (*flag.FlagSet, *string, *int) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	server := fs.String("server", "", "address of a running mhp server (host:port); empty to use the hub directly")
+	hub := fs.Int("hub", 0, "hub to control, also its Alpaca device number")
+	return fs, server, hub
+}
+
+func newController(server string, hub int) (hubController, error) {
+	if server == "" {
+		return newDirectController(hub)
+	}
+	return newAlpacaController(server, hub), nil
+}
+
+func parseOnOff(v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid state %q, expected on or off", v)
+	}
+	return b, nil
+}
+
+func parseNumber(what string, v string) (int64, error) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", what, v)
+	}
+	return n, nil
+}
+
+func commandFailed(err error) int {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	return 1
+}
+
+// mhp switch set <n> <on|off>
+func runSwitch(args []string) int {
+	fs, server, hub := newControlFlags("switch")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(pos) != 3 || pos[0] != "set" {
+		printUsage()
+		return 2
+	}
+	n, err := parseNumber("switch number", pos[1])
+	if err != nil {
+		return commandFailed(err)
+	}
+	on, err := parseOnOff(pos[2])
+	if err != nil {
+		return commandFailed(err)
+	}
+	c, err := newController(*server, *hub)
+	if err != nil {
+		return commandFailed(err)
+	}
+	if err := c.SetSwitch(int32(n), on); err != nil {
+		return commandFailed(err)
+	}
+	return 0
+}
+
+// mhp dew set <n> <level>
+func runDew(args []string) int {
+	fs, server, hub := newControlFlags("dew")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(pos) != 3 || pos[0] != "set" {
+		printUsage()
+		return 2
+	}
+	n, err := parseNumber("dew heater number", pos[1])
+	if err != nil {
+		return commandFailed(err)
+	}
+	level, err := parseNumber("dew heater level", pos[2])
+	if err != nil {
+		return commandFailed(err)
+	}
+	c, err := newController(*server, *hub)
+	if err != nil {
+		return commandFailed(err)
+	}
+	if err := c.SetDew(int32(n), level); err != nil {
+		return commandFailed(err)
+	}
+	return 0
+}
+
+// mhp focuser move <position>
+func runFocuser(args []string) int {
+	fs, server, hub := newControlFlags("focuser")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(pos) != 2 || pos[0] != "move" {
+		printUsage()
+		return 2
+	}
+	position, err := parseNumber("focuser position", pos[1])
+	if err != nil {
+		return commandFailed(err)
+	}
+	if position < 0 || position > 1<<31-1 {
+		return commandFailed(errors.New("focuser position out of range"))
+	}
+	c, err := newController(*server, *hub)
+	if err != nil {
+		return commandFailed(err)
+	}
+	if err := c.Move(int32(position)); err != nil {
+		return commandFailed(err)
+	}
+	return 0
+}
+
+// mhp status
+func runStatus(args []string) int {
+	fs, server, hub := newControlFlags("status")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(pos) != 0 {
+		printUsage()
+		return 2
+	}
+	c, err := newController(*server, *hub)
+	if err != nil {
+		return commandFailed(err)
+	}
+	st, err := c.Status()
+	if err != nil {
+		return commandFailed(err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tVALUE")
+	for _, ch := range st.Channels {
+		value := fmt.Sprint(ch.Value)
+		if ch.Max == 1 {
+			value = "off"
+			if ch.Value != 0 {
+				value = "on"
+			}
+		} else {
+			value += "%"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", ch.Id, ch.Name, value)
+	}
+	fmt.Fprintf(tw, "-\tFocuser\t%d / %d\n", st.FocuserPosition, st.FocuserMaxStep)
+	tw.Flush()
+	return 0
+}
+
+// List all Alpaca servers that answer a discovery broadcast, with their configured devices
+func runDiscover(args []string) int {
+	fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+	port := fs.Uint("port", DiscoveryPort, "Alpaca discovery port")
+	timeout := fs.Duration("timeout", 2*time.Second, "time to wait for replies")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	servers, err := NewDiscoveryClient(uint32(*port), *timeout).Discover()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "discovery failed:", err)
+		return 1
+	}
+	if len(servers) == 0 {
+		fmt.Println("No Alpaca servers found")
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tTYPE\tNUMBER\tNAME\tUNIQUE ID")
+	for _, srv := range servers {
+		addr := fmt.Sprintf("%s:%d", srv.Address, srv.Port)
+		if srv.Err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t(error: %v)\t-\n", addr, srv.Err)
+			continue
+		}
+		if len(srv.Devices) == 0 {
+			fmt.Fprintf(tw, "%s\t-\t-\t(no devices)\t-\n", addr)
+			continue
+		}
+		for _, d := range srv.Devices {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", addr, d.DeviceType, d.DeviceNumber, d.DeviceName, d.UniqueID)
+		}
+	}
+	tw.Flush()
+	return 0
+}
+
+// mhp config check [-file name]
+func runConfig(args []string) int {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	file := fs.String("file", settingsFile, "settings file to check")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(pos) != 1 || pos[0] != "check" {
+		printUsage()
+		return 2
+	}
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return commandFailed(err)
+	}
+	if problems := checkSettings(*file, data); problems != nil {
+		for _, p := range problems {
+			fmt.Println(p.Error())
+		}
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Println(*file, "is valid")
+	return 0
+}
+
+// mhp profile list|save|use|delete|export|import
+func runProfile(args []string) int {
+	fs := flag.NewFlagSet("profile", flag.ContinueOnError)
+	hub := fs.Int("hub", 0, "hub whose settings are saved or replaced")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(pos) == 0 {
+		printUsage()
+		return 2
+	}
+	want := map[string]int{"list": 1, "save": 2, "use": 2, "delete": 2, "export": 3, "import": 3}
+	if n, ok := want[pos[0]]; !ok || len(pos) != n {
+		printUsage()
+		return 2
+	}
+
+	switch pos[0] {
+	case "list":
+		names, err := MhpListProfiles()
+		if err != nil {
+			return commandFailed(err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return 0
+	case "save", "use":
+		// Both work on the current settings
+		if err := MhpSetInit(); err != nil {
+			return commandFailed(err)
+		}
+		if pos[0] == "save" {
+			err = MhpSaveProfile(*hub, pos[1])
+		} else {
+			// The hub belongs to the running server, if there is one. It brings the outputs
+			// within the new limits when it reloads settings.json.
+			_, err = useProfile(*hub, pos[1])
+		}
+	case "delete":
+		err = MhpDeleteProfile(pos[1])
+	case "export":
+		err = MhpExportProfile(pos[1], pos[2])
+	case "import":
+		err = MhpImportProfile(pos[1], pos[2])
+	}
+	if err != nil {
+		return commandFailed(err)
+	}
+	return 0
+}
+
+// mhp hubs, shows the usbpath and usbserial to put in settings.json for each hub
+func runHubs(args []string) int {
+	fs := flag.NewFlagSet("hubs", flag.ContinueOnError)
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(pos) != 0 {
+		printUsage()
+		return 2
+	}
+	found, err := hidList()
+	if err != nil {
+		return commandFailed(err)
+	}
+	if len(found) == 0 {
+		fmt.Println("No Mount Hub Pro found")
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USBPATH\tUSBSERIAL")
+	for _, d := range found {
+		serial := d.Serial
+		if serial == "" {
+			serial = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", d.Path, serial)
+	}
+	tw.Flush()
+	return 0
+}
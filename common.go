@@ -10,83 +10,87 @@ import (
 
 func (srv *ApiServer) configureCommonAPI(router *httprouter.Router) {
 	// ASCOM Methods Common To All Devices
-	router.PUT("/api/v1/switch/1/action", srv.handleNotSupported)
-	router.PUT("/api/v1/focuser/1/action", srv.handleNotSupported)
+	router.PUT("/api/v1/switch/:device_number/action", srv.device(DeviceTypeSwitch, srv.handleSwitchAction))
+	router.PUT("/api/v1/focuser/:device_number/action", srv.device(DeviceTypeFocuser, srv.handleNotSupported))
 
-	router.PUT("/api/v1/switch/1/commandblind", srv.handleNotSupported)
-	router.PUT("/api/v1/focuser/1/commandblind", srv.handleNotSupported)
+	router.PUT("/api/v1/switch/:device_number/commandblind", srv.device(DeviceTypeSwitch, srv.handleNotSupported))
+	router.PUT("/api/v1/focuser/:device_number/commandblind", srv.device(DeviceTypeFocuser, srv.handleNotSupported))
 
-	router.PUT("/api/v1/switch/1/commandbool", srv.handleNotSupported)
-	router.PUT("/api/v1/focuser/1/commandbool", srv.handleNotSupported)
+	router.PUT("/api/v1/switch/:device_number/commandbool", srv.device(DeviceTypeSwitch, srv.handleNotSupported))
+	router.PUT("/api/v1/focuser/:device_number/commandbool", srv.device(DeviceTypeFocuser, srv.handleNotSupported))
 
-	router.PUT("/api/v1/switch/1/commandstring", srv.handleNotSupported)
-	router.PUT("/api/v1/focuser/1/commandstring", srv.handleNotSupported)
+	router.PUT("/api/v1/switch/:device_number/commandstring", srv.device(DeviceTypeSwitch, srv.handleNotSupported))
+	router.PUT("/api/v1/focuser/:device_number/commandstring", srv.device(DeviceTypeFocuser, srv.handleNotSupported))
 
-	router.GET("/api/v1/switch/1/connected", srv.handleConnected)
-	router.GET("/api/v1/focuser/1/connected", srv.handleConnected)
+	router.GET("/api/v1/switch/:device_number/connected", srv.device(DeviceTypeSwitch, srv.handleConnected(DeviceTypeSwitch)))
+	router.GET("/api/v1/focuser/:device_number/connected", srv.device(DeviceTypeFocuser, srv.handleConnected(DeviceTypeFocuser)))
 
-	router.PUT("/api/v1/switch/1/connected", srv.handleConnect)
-	router.PUT("/api/v1/focuser/1/connected", srv.handleConnect)
+	router.PUT("/api/v1/switch/:device_number/connected", srv.device(DeviceTypeSwitch, srv.handleConnect(DeviceTypeSwitch)))
+	router.PUT("/api/v1/focuser/:device_number/connected", srv.device(DeviceTypeFocuser, srv.handleConnect(DeviceTypeFocuser)))
 
-	router.GET("/api/v1/switch/1/description", srv.handleDescriptionCommon)
-	router.GET("/api/v1/focuser/1/description", srv.handleDescriptionCommon)
+	router.GET("/api/v1/switch/:device_number/description", srv.device(DeviceTypeSwitch, srv.handleDescriptionCommon))
+	router.GET("/api/v1/focuser/:device_number/description", srv.device(DeviceTypeFocuser, srv.handleDescriptionCommon))
 
-	router.GET("/api/v1/switch/1/driverinfo", srv.handleDriverinfo)
-	router.GET("/api/v1/focuser/1/driverinfo", srv.handleDriverinfo)
+	router.GET("/api/v1/switch/:device_number/driverinfo", srv.device(DeviceTypeSwitch, srv.handleDriverinfo))
+	router.GET("/api/v1/focuser/:device_number/driverinfo", srv.device(DeviceTypeFocuser, srv.handleDriverinfo))
 
-	router.GET("/api/v1/switch/1/driverversion", srv.handleDriverVersion)
-	router.GET("/api/v1/focuser/1/driverversion", srv.handleDriverVersion)
+	router.GET("/api/v1/switch/:device_number/driverversion", srv.device(DeviceTypeSwitch, srv.handleDriverVersion))
+	router.GET("/api/v1/focuser/:device_number/driverversion", srv.device(DeviceTypeFocuser, srv.handleDriverVersion))
 
-	router.GET("/api/v1/switch/1/interfaceversion", srv.handleInterfaceVersion)
-	router.GET("/api/v1/focuser/1/interfaceversion", srv.handleInterfaceVersion)
+	router.GET("/api/v1/switch/:device_number/interfaceversion", srv.device(DeviceTypeSwitch, srv.handleInterfaceVersion))
+	router.GET("/api/v1/focuser/:device_number/interfaceversion", srv.device(DeviceTypeFocuser, srv.handleInterfaceVersion))
 
-	router.GET("/api/v1/switch/1/name", srv.handleName)
-	router.GET("/api/v1/focuser/1/name", srv.handleName)
+	router.GET("/api/v1/switch/:device_number/name", srv.device(DeviceTypeSwitch, srv.handleName))
+	router.GET("/api/v1/focuser/:device_number/name", srv.device(DeviceTypeFocuser, srv.handleName))
 
-	router.GET("/api/v1/switch/1/supportedactions", srv.handleSupportedActions)
-	router.GET("/api/v1/focuser/1/supportedactions", srv.handleSupportedActions)
+	router.GET("/api/v1/switch/:device_number/supportedactions", srv.device(DeviceTypeSwitch, srv.handleSwitchSupportedActions))
+	router.GET("/api/v1/focuser/:device_number/supportedactions", srv.device(DeviceTypeFocuser, srv.handleSupportedActions))
 }
 
 // ASCOM Common API handlers
 
-// Retrieves the connected state of the device (GET)
-func (srv *ApiServer) handleConnected(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// This is the GET commend
-	result := MhpGetConnected()
-	resp := booleanResponse{
-		Value: result,
+// Retrieves the connected state of the device for the client making the request (GET)
+func (srv *ApiServer) handleConnected(deviceType string) hubHandle {
+	return func(w http.ResponseWriter, r *http.Request, hub int) {
+		// This is the GET commend
+		result := clientConnected(r, deviceType, hub)
+		resp := booleanResponse{
+			Value: result,
+		}
+		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
 	}
-	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(resp)
 }
 
-// Sets the connected state of the device (PUT)
-func (srv *ApiServer) handleConnect(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	cn, err := getConnectedFromRequest(r)
-	if err != nil {
+// Connects or disconnects the client making the request (PUT)
+func (srv *ApiServer) handleConnect(deviceType string) hubHandle {
+	return func(w http.ResponseWriter, r *http.Request, hub int) {
+		cn, err := getConnectedFromRequest(r)
+		if err != nil {
+			resp := stringResponse{
+				Value: err.Error(),
+			}
+			srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		setClientConnected(r, deviceType, hub, cn)
 		resp := stringResponse{
-			Value: err.Error(),
+			Value: "",
 		}
 		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(resp)
-		return
-	}
-	MhpSetConnect(cn)
-	resp := stringResponse{
-		Value: "",
 	}
-	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(resp)
 }
 
 // The description of the device
-func (srv *ApiServer) handleDescriptionCommon(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (srv *ApiServer) handleDescriptionCommon(w http.ResponseWriter, r *http.Request, hub int) {
 	result := "Mount Hub Pro"
 	resp := stringResponse{
 		Value: result,
@@ -98,7 +102,7 @@ func (srv *ApiServer) handleDescriptionCommon(w http.ResponseWriter, r *http.Req
 }
 
 // A string containing only the major and minor version of the driver.
-func (srv *ApiServer) handleDriverinfo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (srv *ApiServer) handleDriverinfo(w http.ResponseWriter, r *http.Request, hub int) {
 	result := "Alpaca Mount Hub Pro Driver https://github.com/exploded/mhp-ascom-alpaca"
 	resp := stringResponse{
 		Value: result,
@@ -110,7 +114,7 @@ func (srv *ApiServer) handleDriverinfo(w http.ResponseWriter, r *http.Request, p
 }
 
 // A string containing only the major and minor version of the driver.
-func (srv *ApiServer) handleDriverVersion(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (srv *ApiServer) handleDriverVersion(w http.ResponseWriter, r *http.Request, hub int) {
 	bi, _ := debug.ReadBuildInfo()
 	resp := stringResponse{
 		Value: bi.Main.Version,
@@ -126,7 +130,7 @@ func (srv *ApiServer) handleDriverVersion(w http.ResponseWriter, r *http.Request
 // devices should be built to the latest interface version. Applications can choose which
 // device interface versions they support and it is in their interest to support previous
 // versions as well as the current version to ensure thay can use the largest number of devices.
-func (srv *ApiServer) handleInterfaceVersion(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (srv *ApiServer) handleInterfaceVersion(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := int32Response{
 		Value: 2,
 	}
@@ -137,7 +141,7 @@ func (srv *ApiServer) handleInterfaceVersion(w http.ResponseWriter, r *http.Requ
 }
 
 // The name of the device
-func (srv *ApiServer) handleName(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (srv *ApiServer) handleName(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := stringResponse{
 		Value: "Mount Hub Pro",
 	}
@@ -148,7 +152,7 @@ func (srv *ApiServer) handleName(w http.ResponseWriter, r *http.Request, ps http
 }
 
 // Returns the list of action names supported by this driver.
-func (srv *ApiServer) handleSupportedActions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (srv *ApiServer) handleSupportedActions(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := stringlistResponse{
 		Value: []string{""},
 	}
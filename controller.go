@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// A hubController performs the operations offered on the command line, either directly
+// against the hub or through a running server's Alpaca API.
+// Switches are numbered 1 to NumOnOffSwitch and dew heaters 1 to NumVarSwitch.
+type hubController interface {
+	SetSwitch(n int32, on bool) error
+	SetDew(n int32, level int64) error
+	Move(position int32) error
+	Status() (hubStatus, error)
+}
+
+type hubStatus struct {
+	Channels        []channelStatus
+	FocuserPosition int32
+	FocuserMaxStep  int32
+}
+
+type channelStatus struct {
+	Id    int32 // Alpaca switch id, 0 to MaxSwitch - 1
+	Name  string
+	Value int64
+	Max   int64
+}
+
+func checkSwitchNumber(n int32) error {
+	if n < 1 || n > NumOnOffSwitch {
+		return fmt.Errorf("switch number must be 1 to %d", NumOnOffSwitch)
+	}
+	return nil
+}
+
+func checkDewNumber(n int32) error {
+	if n < 1 || n > NumVarSwitch {
+		return fmt.Errorf("dew heater number must be 1 to %d", NumVarSwitch)
+	}
+	return nil
+}
+
+// Talks to the hub over USB using the same functions as the server
+type directController struct {
+	hub int
+}
+
+func newDirectController(hub int) (*directController, error) {
+	if err := MhpSetInit(); err != nil {
+		return nil, err
+	}
+	if err := checkHub(hub); err != nil {
+		return nil, err
+	}
+	return &directController{hub: hub}, nil
+}
+
+func (c *directController) SetSwitch(n int32, on bool) error {
+	if err := checkSwitchNumber(n); err != nil {
+		return err
+	}
+	return MhpSetOnOff(c.hub, n, on, localOrigin(SourceCommandLine))
+}
+
+func (c *directController) SetDew(n int32, level int64) error {
+	if err := checkDewNumber(n); err != nil {
+		return err
+	}
+	return MhpSetValue(c.hub, NumOnOffSwitch+n, level, localOrigin(SourceCommandLine))
+}
+
+func (c *directController) Move(position int32) error {
+	return MhpMove(c.hub, position, localOrigin(SourceCommandLine))
+}
+
+func (c *directController) Status() (st hubStatus, err error) {
+	for id := int32(1); id <= NumSwitches; id++ {
+		st.Channels = append(st.Channels, channelStatus{
+			Id:    id - 1,
+			Name:  MhpGetName(c.hub, id),
+			Value: MhpGetValue(c.hub, id),
+			Max:   MhpGetMax(c.hub, id),
+		})
+	}
+	st.FocuserPosition = MhpGetPosition(c.hub)
+	st.FocuserMaxStep = MhpGetMaxStep(c.hub)
+	return
+}
+
+// Talks to a running mhp server through the Alpaca REST API
+type alpacaController struct {
+	client        *AlpacaClient
+	switchDevice  string // e.g. "switch/0"
+	focuserDevice string // e.g. "focuser/0"
+}
+
+func newAlpacaController(server string, hub int) *alpacaController {
+	return &alpacaController{
+		client:        NewAlpacaClient(server),
+		switchDevice:  fmt.Sprintf("switch/%d", hub),
+		focuserDevice: fmt.Sprintf("focuser/%d", hub),
+	}
+}
+
+func (c *alpacaController) SetSwitch(n int32, on bool) error {
+	if err := checkSwitchNumber(n); err != nil {
+		return err
+	}
+	return c.client.Put(c.switchDevice, "setswitch", url.Values{
+		"Id":    {fmt.Sprint(n - 1)},
+		"State": {fmt.Sprint(on)},
+	})
+}
+
+func (c *alpacaController) SetDew(n int32, level int64) error {
+	if err := checkDewNumber(n); err != nil {
+		return err
+	}
+	return c.client.Put(c.switchDevice, "setswitchvalue", url.Values{
+		"Id":    {fmt.Sprint(NumOnOffSwitch + n - 1)},
+		"Value": {fmt.Sprint(level)},
+	})
+}
+
+func (c *alpacaController) Move(position int32) error {
+	return c.client.Put(c.focuserDevice, "move", url.Values{
+		"Position": {fmt.Sprint(position)},
+	})
+}
+
+func (c *alpacaController) Status() (st hubStatus, err error) {
+	var maxswitch int32Response
+	if err = c.client.Get(c.switchDevice, "maxswitch", nil, &maxswitch); err != nil {
+		return
+	}
+	if maxswitch.Value < 0 || maxswitch.Value > NumSwitches {
+		err = errors.New("unexpected number of switches reported by server")
+		return
+	}
+	for id := int32(0); id < maxswitch.Value; id++ {
+		params := url.Values{"Id": {fmt.Sprint(id)}}
+		var name stringResponse
+		var value, max doubleResponse
+		if err = c.client.Get(c.switchDevice, "getswitchname", params, &name); err != nil {
+			return
+		}
+		if err = c.client.Get(c.switchDevice, "getswitchvalue", params, &value); err != nil {
+			return
+		}
+		if err = c.client.Get(c.switchDevice, "maxswitchvalue", params, &max); err != nil {
+			return
+		}
+		st.Channels = append(st.Channels, channelStatus{
+			Id:    id,
+			Name:  name.Value,
+			Value: value.Value,
+			Max:   max.Value,
+		})
+	}
+	var position, maxstep int32Response
+	if err = c.client.Get(c.focuserDevice, "position", nil, &position); err != nil {
+		return
+	}
+	if err = c.client.Get(c.focuserDevice, "maxstep", nil, &maxstep); err != nil {
+		return
+	}
+	st.FocuserPosition = position.Value
+	st.FocuserMaxStep = maxstep.Value
+	return
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Critical channels, such as the port powering the mount, cannot be turned off by a single
+// client request. The first request is refused with a token; the change is made when the same
+// client repeats the request within confirmwindow seconds, or when any client passes the token
+// to the ConfirmSwitchOff action. Only clients with a ClientID can confirm by repeating, others
+// on the same host would otherwise confirm for each other. Changes made by the driver itself, the boot sequence and
+// schedules included, are not held back. Every change to a critical channel is audited.
+
+const defaultConfirmWindow = 10 // seconds
+
+type confirmKey struct {
+	hub *sw
+	id  int32
+}
+
+type pendingConfirm struct {
+	client  string
+	token   string
+	expires time.Time
+}
+
+var confirmations = struct {
+	sync.Mutex
+	pending map[confirmKey]pendingConfirm
+}{pending: make(map[confirmKey]pendingConfirm)}
+
+// Check that channel id may be set to value by o, asking for confirmation if it is a critical
+// channel being turned off. Caller holds s.changes.
+func (s *sw) confirmChange(id int32, value int64, o changeOrigin) error {
+	sm.Lock()
+	critical, current, window := s.Critical[id], s.Value[id], s.Confirmwindow
+	sm.Unlock()
+	if !critical || value != 0 || current == 0 || !o.remote() {
+		return nil
+	}
+
+	key := confirmKey{s, id}
+	now := time.Now()
+	confirmations.Lock()
+	defer confirmations.Unlock()
+	p, ok := confirmations.pending[key]
+	if ok && now.After(p.expires) {
+		delete(confirmations.pending, key)
+		ok = false
+	}
+	switch {
+	case ok && o.Token == p.token, ok && o.Token == "" && o.canRepeat() && o.client() == p.client:
+		delete(confirmations.pending, key)
+		auditRecord(s.auditEntry(AuditConfirmed, id, current, value, o))
+		return nil
+	case o.Token != "":
+		auditRecord(s.auditEntry(AuditRefused, id, current, value, o))
+		return refused("%s: the confirmation token is wrong or has expired", s.getname(id))
+	}
+
+	token := s.requestConfirmation(key, o, window)
+	auditRecord(s.auditEntry(AuditRequested, id, current, value, o))
+	if !o.canRepeat() {
+		return refused("%s is critical, confirm with token %s within %d seconds to turn it off",
+			s.getname(id), token, window)
+	}
+	return refused("%s is critical, repeat the request within %d seconds to turn it off or confirm with token %s",
+		s.getname(id), window, token)
+}
+
+// Start waiting for confirmation, replacing any earlier request. Caller holds confirmations.
+func (s *sw) requestConfirmation(key confirmKey, o changeOrigin, window int32) string {
+	p := pendingConfirm{
+		client:  o.client(),
+		token:   newUniqueID()[:8],
+		expires: time.Now().Add(time.Duration(window) * time.Second),
+	}
+	confirmations.pending[key] = p
+	return p.token
+}
+
+// Ask to turn off a critical power port, returning the token for the ConfirmSwitchOff action
+func MhpRequestSwitchOff(hub int, id int32, o changeOrigin) (string, error) {
+	if err := checkHub(hub); err != nil {
+		return "", err
+	}
+	if err := checkSwitchNumber(id); err != nil {
+		return "", err
+	}
+	h := hubs[hub]
+	sm.Lock()
+	critical, current, window := h.Critical[id], h.Value[id], h.Confirmwindow
+	sm.Unlock()
+	if !critical {
+		return "", refused("%s is not critical, it can be turned off directly", h.getname(id))
+	}
+	if current == 0 {
+		return "", refused("%s is already off", h.getname(id))
+	}
+
+	confirmations.Lock()
+	token := h.requestConfirmation(confirmKey{h, id}, o, window)
+	confirmations.Unlock()
+	auditRecord(h.auditEntry(AuditRequested, id, current, 0, o))
+	return token, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func bitsOf(values ...int) uint64 {
+	var bits uint64
+	for _, v := range values {
+		bits |= 1 << v
+	}
+	return bits
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     uint64
+		wantErr  bool
+	}{
+		{field: "*", min: 0, max: 5, want: bitsOf(0, 1, 2, 3, 4, 5)},
+		{field: "7", min: 0, max: 59, want: bitsOf(7)},
+		{field: "1-3", min: 0, max: 59, want: bitsOf(1, 2, 3)},
+		{field: "1,3,5-6", min: 0, max: 59, want: bitsOf(1, 3, 5, 6)},
+		{field: "*/15", min: 0, max: 59, want: bitsOf(0, 15, 30, 45)},
+		{field: "10/20", min: 0, max: 59, want: bitsOf(10, 30, 50)},
+		{field: "1-5/2", min: 0, max: 7, want: bitsOf(1, 3, 5)},
+		{field: "*/5", min: 1, max: 12, want: bitsOf(1, 6, 11)},
+		{field: "0,7", min: 0, max: 7, want: bitsOf(0, 7)},
+		{field: "60", min: 0, max: 59, wantErr: true},
+		{field: "0", min: 1, max: 31, wantErr: true},
+		{field: "5-3", min: 0, max: 59, wantErr: true},
+		{field: "*/0", min: 0, max: 59, wantErr: true},
+		{field: "*/x", min: 0, max: 59, wantErr: true},
+		{field: "a", min: 0, max: 59, wantErr: true},
+		{field: "1-b", min: 0, max: 59, wantErr: true},
+		{field: "", min: 0, max: 59, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.field, tt.min, tt.max)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseCronField(%q, %d, %d): no error", tt.field, tt.min, tt.max)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseCronField(%q, %d, %d) = %b, %v, want %b", tt.field, tt.min, tt.max, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 32 * *", "* * * 13 *", "* * * * 8"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q): no error", expr)
+		}
+	}
+}
+
+func localTime(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestCronMatches(t *testing.T) {
+	tests := []struct {
+		expr string
+		at   string
+		want bool
+	}{
+		{"30 21 * * *", "2026-03-14 21:30", true},
+		{"30 21 * * *", "2026-03-14 21:31", false},
+		{"30 21 * * *", "2026-03-14 20:30", false},
+		{"*/15 * * * *", "2026-03-14 10:45", true},
+		{"*/15 * * * *", "2026-03-14 10:46", false},
+		{"0 9-17/4 * * *", "2026-03-14 13:00", true},
+		{"0 9-17/4 * * *", "2026-03-14 15:00", false},
+		// Day of week only
+		{"0 7 * * 1-5", "2026-03-20 07:00", true},  // Friday
+		{"0 7 * * 1-5", "2026-03-14 07:00", false}, // Saturday
+		{"0 0 * * 0", "2026-03-15 00:00", true},    // Sunday as 0
+		{"0 0 * * 7", "2026-03-15 00:00", true},    // and as 7
+		// Day of month only
+		{"0 0 13 * *", "2026-03-13 00:00", true},
+		{"0 0 13 * *", "2026-03-14 00:00", false},
+		// Both restricted, either matches
+		{"0 0 1 * 5", "2026-03-06 00:00", true},  // Friday the 6th
+		{"0 0 1 * 5", "2026-04-01 00:00", true},  // Wednesday the 1st
+		{"0 0 1 * 5", "2026-03-07 00:00", false}, // Saturday the 7th
+		// Month
+		{"0 0 * 2 *", "2026-02-10 00:00", true},
+		{"0 0 * 2 *", "2026-03-10 00:00", false},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		if got := spec.matches(localTime(tt.at)); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.expr, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr   string
+		after  string
+		want   string
+		wantOk bool
+	}{
+		{"*/15 * * * *", "2026-03-14 10:07", "2026-03-14 10:15", true},
+		{"0 22 * * *", "2026-03-14 22:00", "2026-03-15 22:00", true},  // strictly after
+		{"0 7 * * 1-5", "2026-03-20 08:00", "2026-03-23 07:00", true}, // Friday to Monday
+		{"30 6 1 * *", "2026-12-05 00:00", "2027-01-01 06:30", true},
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00", true},
+		{"0 0 30 2 *", "2026-03-01 00:00", "", false},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		got, ok := spec.next(localTime(tt.after))
+		if ok != tt.wantOk || (ok && !got.Equal(localTime(tt.want))) {
+			t.Errorf("%q next after %s = %s, %v, want %s, %v", tt.expr, tt.after, got.Format("2006-01-02 15:04"), ok, tt.want, tt.wantOk)
+		}
+	}
+}
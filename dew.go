@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Automatic dew heater control. Each heater can be left in manual mode, where it is set by
+// clients, put in auto mode, where its power follows how close the ambient temperature is
+// to the dew point, or in schedule mode, see dewschedule.go. In auto mode the heater is driven
+// harder the further the gap between the temperature and the dew point falls below the
+// heater's target margin.
+
+// Dew heater modes
+const (
+	DewManual   = "manual"   // set by clients
+	DewAuto     = "auto"     // driven from the dew point
+	DewSchedule = "schedule" // on at night, see dewschedule.go
+)
+
+// Dew heater control loops
+const (
+	DewProportional = "proportional"
+	DewPID          = "pid"
+)
+
+// Settings of one dew heater, the dewheaters list in settings.json is in heater order
+type dewHeater struct {
+	Mode       string  `json:"mode"`       // manual, auto or schedule
+	Control    string  `json:"control"`    // proportional or pid
+	Aggression float64 `json:"aggression"` // 1 to 10, % power per °C inside the margin is 5 times this
+	Margin     float64 `json:"margin"`     // °C above the dew point to keep clear of
+	Ki         float64 `json:"ki"`         // pid only, % power per °C minute
+	Kd         float64 `json:"kd"`         // pid only, % power per °C per minute
+	Level      int64   `json:"level"`      // schedule only, % power at night
+}
+
+func defaultDewHeater() dewHeater {
+	return dewHeater{
+		Mode:       DewManual,
+		Control:    DewProportional,
+		Aggression: 5,
+		Margin:     5,
+		Ki:         1,
+		Kd:         0,
+		Level:      50,
+	}
+}
+
+// Dew point in °C by the Magnus formula
+func dewPoint(temperature float64, humidity float64) float64 {
+	const b, c = 17.62, 243.12
+	gamma := math.Log(humidity/100) + b*temperature/(c+temperature)
+	return c * gamma / (b - gamma)
+}
+
+// The state of the control loop of one heater
+type dewLoop struct {
+	running   bool
+	integral  float64 // °C minutes
+	lastError float64
+	last      time.Time
+}
+
+// Power in % for a heater given how far, in °C, the gap to the dew point is inside the margin
+func (l *dewLoop) power(c dewHeater, e float64, now time.Time) float64 {
+	kp := c.Aggression * 5
+	out := kp * e
+	if c.Control == DewPID {
+		if l.running {
+			minutes := now.Sub(l.last).Minutes()
+			if minutes > 0 {
+				l.integral += e * minutes
+				// Stop the integral winding up beyond what the heater can deliver
+				if c.Ki > 0 {
+					l.integral = math.Max(0, math.Min(l.integral, 100/c.Ki))
+				}
+				out += c.Kd * (e - l.lastError) / minutes
+			}
+		}
+		out += c.Ki * l.integral
+	}
+	l.running = true
+	l.lastError = e
+	l.last = now
+	return out
+}
+
+func (l *dewLoop) reset() {
+	*l = dewLoop{}
+}
+
+// Report whether heater n, 1 to NumVarSwitch, is set by the dew controller rather than by clients
+func (s *sw) dewAutomatic(n int32) bool {
+	sm.Lock()
+	defer sm.Unlock()
+	return s.Dewheaters[n-1].Mode == DewAuto
+}
+
+// Run the dew controller of a hub until ctx is cancelled
+func MhpRunDewControl(ctx context.Context, hub int) {
+	h := hubs[hub]
+	var reader weatherReader
+	var loops [NumVarSwitch]dewLoop
+	var lastErr string
+	for {
+		sm.Lock()
+		source := h.Weather
+		heaters := h.Dewheaters
+		sm.Unlock()
+
+		err := h.dewControlStep(&reader, &loops, source, heaters)
+		if err != nil && err.Error() != lastErr {
+			// Only log when the problem changes, the source may be down for hours
+			log.Println("Dew control of hub", hub, ":", err)
+		}
+		lastErr = ""
+		if err != nil {
+			lastErr = err.Error()
+		}
+
+		interval := time.Duration(source.Interval) * time.Second
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *sw) dewControlStep(reader *weatherReader, loops *[NumVarSwitch]dewLoop, source weatherSource, heaters [NumVarSwitch]dewHeater) error {
+	automatic := false
+	for n, c := range heaters {
+		if c.Mode == DewAuto {
+			automatic = true
+		} else {
+			loops[n].reset()
+		}
+	}
+	if !automatic {
+		return nil
+	}
+
+	reading, err := reader.read(source)
+	if err != nil {
+		return fmt.Errorf("unable to read the weather, dew heaters left as they are: %w", err)
+	}
+	dp := dewPoint(reading.Temperature, reading.Humidity)
+	spread := reading.Temperature - dp
+
+	var errs []error
+	now := time.Now()
+	for n, c := range heaters {
+		if c.Mode != DewAuto {
+			continue
+		}
+		id := int32(NumOnOffSwitch + 1 + n)
+		sm.Lock()
+		min, max, step, current := s.Min[id], s.Max[id], s.Step[id], s.Value[id]
+		sm.Unlock()
+
+		power := loops[n].power(c, c.Margin-spread, now)
+		value := int64(math.Round(power/float64(step))) * step
+		value = int64(math.Max(float64(min), math.Min(float64(value), float64(max))))
+		if value == current {
+			continue
+		}
+		// Like any other change, canwrite and the interlocks apply
+		err := s.change(id, value, localOrigin(SourceDewControl), func() error {
+			return s.setvalue(id, value, localOrigin(SourceDewControl))
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dew heater %d: %w", n+1, err))
+			continue
+		}
+		log.Printf("Dew heater %d set to %d%%, temperature %.1f°C, humidity %.0f%%, dew point %.1f°C", n+1, value, reading.Temperature, reading.Humidity, dp)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Night-time schedule for the dew heaters. Heaters in schedule mode are turned on at an offset
+// from sunset, ramped up to their level and turned off at an offset from sunrise. The schedule
+// sets the heaters through MhpSetValue like any client, and only when its own value changes,
+// so a heater set by hand keeps that value until the next step of the schedule.
+
+const dewScheduleInterval = 30 * time.Second
+
+// Timing of the schedule, the dewschedule section of settings.json
+type dewSchedule struct {
+	Latitude      float64 `json:"latitude"`      // degrees, north positive, 0 and 0 for no site
+	Longitude     float64 `json:"longitude"`     // degrees, east positive
+	Sunsetoffset  int32   `json:"sunsetoffset"`  // minutes after sunset to turn on, negative for before
+	Sunriseoffset int32   `json:"sunriseoffset"` // minutes after sunrise to turn off, negative for before
+	Ramp          int32   `json:"ramp"`          // minutes to go from off to the full level
+}
+
+// Report whether a site has been given, 0 and 0 is the default and lies out at sea
+func (c dewSchedule) hasSite() bool {
+	return c.Latitude != 0 || c.Longitude != 0
+}
+
+func defaultDewSchedule() dewSchedule {
+	return dewSchedule{
+		Sunsetoffset:  0,
+		Sunriseoffset: 30,
+		Ramp:          30,
+	}
+}
+
+// The night a schedule is on for: from the sunset offset to the sunrise offset
+type dewNight struct {
+	Sunset  time.Time
+	Sunrise time.Time
+	On      time.Time
+	Off     time.Time
+}
+
+// The night that now falls in, or if it is daytime the next one. ok is false
+// if there is no sunset or sunrise in the next few days, as near the poles, or no site is set.
+func (c dewSchedule) night(now time.Time) (night dewNight, ok bool) {
+	if !c.hasSite() {
+		return dewNight{}, false
+	}
+	utc := now.UTC()
+	for d := -1; d <= 2; d++ {
+		day := utc.AddDate(0, 0, d)
+		_, sunset, ok1 := sunTimes(day, c.Latitude, c.Longitude)
+		sunrise, _, ok2 := sunTimes(day.AddDate(0, 0, 1), c.Latitude, c.Longitude)
+		if !ok1 || !ok2 {
+			continue
+		}
+		n := dewNight{
+			Sunset:  sunset,
+			Sunrise: sunrise,
+			On:      sunset.Add(time.Duration(c.Sunsetoffset) * time.Minute),
+			Off:     sunrise.Add(time.Duration(c.Sunriseoffset) * time.Minute),
+		}
+		if now.Before(n.Off) && n.On.Before(n.Off) {
+			return n, true
+		}
+	}
+	return dewNight{}, false
+}
+
+// Power for a heater with the given level at time now: off during the day, ramping up after
+// the on time and at the full level for the rest of the night
+func (c dewSchedule) level(now time.Time, night dewNight, level int64) int64 {
+	if now.Before(night.On) || !now.Before(night.Off) {
+		return 0
+	}
+	ramp := time.Duration(c.Ramp) * time.Minute
+	if elapsed := now.Sub(night.On); elapsed < ramp {
+		return int64(float64(level) * float64(elapsed) / float64(ramp))
+	}
+	return level
+}
+
+// What the schedule of a hub is doing, shown on the setup page
+type dewScheduleStatus struct {
+	Night   dewNight
+	HasSun  bool
+	Heaters []dewScheduleHeater
+}
+
+type dewScheduleHeater struct {
+	Number int
+	Name   string
+	Level  int64 // level at night
+	Now    int64 // level the schedule wants now
+}
+
+// The schedule of a hub at time now. Heaters is empty if none are in schedule mode.
+func MhpGetDewSchedule(hub int, now time.Time) (st dewScheduleStatus) {
+	h := hubs[hub]
+	sm.Lock()
+	schedule := h.Dewschedule
+	heaters := h.Dewheaters
+	sm.Unlock()
+
+	st.Night, st.HasSun = schedule.night(now)
+	for n, c := range heaters {
+		if c.Mode != DewSchedule {
+			continue
+		}
+		hs := dewScheduleHeater{
+			Number: n + 1,
+			Name:   MhpGetName(hub, int32(NumOnOffSwitch+1+n)),
+			Level:  c.Level,
+		}
+		if st.HasSun {
+			hs.Now = schedule.level(now, st.Night, c.Level)
+		}
+		st.Heaters = append(st.Heaters, hs)
+	}
+	return
+}
+
+// Run the dew schedule of a hub until ctx is cancelled
+func MhpRunDewSchedule(ctx context.Context, hub int) {
+	// Value last set by the schedule for each heater, -1 before the first step
+	last := [NumVarSwitch]int64{-1, -1, -1, -1}
+	var lastErr [NumVarSwitch]string
+	for {
+		st := MhpGetDewSchedule(hub, time.Now())
+		scheduled := [NumVarSwitch]bool{}
+		for _, hs := range st.Heaters {
+			n := hs.Number - 1
+			scheduled[n] = true
+			id := int32(NumOnOffSwitch + hs.Number)
+			value := roundToStep(hub, id, hs.Now)
+			if value == last[n] {
+				continue
+			}
+			if err := MhpSetValue(hub, id, value, localOrigin(SourceDewSchedule)); err != nil {
+				// Tried again on the next step, only log when the problem changes
+				if err.Error() != lastErr[n] {
+					log.Println("Dew schedule could not set", hs.Name, ":", err)
+				}
+				lastErr[n] = err.Error()
+				continue
+			}
+			lastErr[n] = ""
+			if last[n] == 0 && value > 0 {
+				log.Printf("Dew schedule: %s on, sunset %s", hs.Name, st.Night.Sunset.Local().Format("15:04"))
+			} else if value == 0 && last[n] > 0 {
+				log.Printf("Dew schedule: %s off until %s", hs.Name, st.Night.On.Local().Format("Mon 15:04"))
+			}
+			last[n] = value
+		}
+		for n := range last {
+			if !scheduled[n] {
+				last[n] = -1
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dewScheduleInterval):
+		}
+	}
+}
+
+// Round a heater value to the step of the channel
+func roundToStep(hub int, id int32, value int64) int64 {
+	step := MhpGetStep(hub, id)
+	if step > 1 {
+		value = (value + step/2) / step * step
+	}
+	return value
+}
+
+// Describe the night for the setup page
+func (n dewNight) String() string {
+	return fmt.Sprintf("on %s (sunset %s), off %s (sunrise %s)",
+		n.On.Local().Format("Mon 15:04"), n.Sunset.Local().Format("15:04"),
+		n.Off.Local().Format("Mon 15:04"), n.Sunrise.Local().Format("15:04"))
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 //Implementation of ASCOM Alpaca discovery protocol
@@ -15,6 +18,9 @@ type DiscoveryServer struct {
 	Conn         net.PacketConn
 	ApiPort      uint32
 	ListenString string
+	bound        atomic.Bool // listening for discovery packets, see health.go
+	closing      sync.Mutex  // held while Conn is set or closed, Close can be called before Start
+	closed       bool
 }
 
 func NewDiscoverySever(listenPort uint32, apiPort uint32) *DiscoveryServer {
@@ -38,12 +44,23 @@ func (s *DiscoveryServer) Start() {
 		log.Fatal(err)
 		//Fatal(err)
 	}
+	s.closing.Lock()
+	if s.closed {
+		s.closing.Unlock()
+		udpServer.Close()
+		return
+	}
 	s.Conn = udpServer
+	s.bound.Store(true)
+	s.closing.Unlock()
 	defer s.Close()
 	//Listen for discovery packets on all interfaces
 	for {
 		buf := make([]byte, 1024)
 		_, addr, err := udpServer.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			continue
 		}
@@ -51,7 +68,10 @@ func (s *DiscoveryServer) Start() {
 		msg := string(buf)
 		//Only handle and reply to discovery packets 1st version
 		if strings.HasPrefix(msg, "alpacadiscovery1") {
+			metricsDiscoveryPacket(true)
 			go s.handleDiscoveryPacket(addr)
+		} else {
+			metricsDiscoveryPacket(false)
 		}
 	}
 }
@@ -65,6 +85,17 @@ func (s *DiscoveryServer) handleDiscoveryPacket(addr net.Addr) {
 	s.Conn.WriteTo([]byte(s.composeDiscoveryReply()), addr)
 }
 
+// Report whether the discovery socket is bound
+func (s *DiscoveryServer) Bound() bool {
+	return s.bound.Load()
+}
+
 func (s *DiscoveryServer) Close() {
-	s.Conn.Close()
+	s.closing.Lock()
+	defer s.closing.Unlock()
+	s.closed = true
+	s.bound.Store(false)
+	if s.Conn != nil {
+		s.Conn.Close()
+	}
 }
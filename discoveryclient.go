@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Client side of the ASCOM Alpaca discovery protocol, the counterpart of DiscoveryServer.
+// It broadcasts "alpacadiscovery1", collects the AlpacaPort replies and then asks each
+// responding server which devices it has configured.
+
+type DiscoveryClient struct {
+	DiscoveryPort uint32
+	Timeout       time.Duration
+}
+
+// An Alpaca server that replied to a discovery broadcast
+type AlpacaServer struct {
+	Address string
+	Port    uint32
+	Devices []DeviceConfiguration
+	Err     error
+}
+
+type discoveryReply struct {
+	AlpacaPort uint32 `json:"AlpacaPort"`
+}
+
+func NewDiscoveryClient(discoveryPort uint32, timeout time.Duration) *DiscoveryClient {
+	if discoveryPort > 65535 || discoveryPort < 1 {
+		discoveryPort = DiscoveryPort
+	}
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return &DiscoveryClient{
+		DiscoveryPort: discoveryPort,
+		Timeout:       timeout,
+	}
+}
+
+// Discover broadcasts a discovery packet and returns every server that replied before the timeout,
+// along with the devices each one reports from /management/v1/configureddevices.
+func (c *DiscoveryClient) Discover() ([]AlpacaServer, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The broadcast reaches the rest of the network, the loopback address catches a server
+	// on this machine that is only listening on ListenIP.
+	targets := []string{
+		fmt.Sprintf("255.255.255.255:%d", c.DiscoveryPort),
+		fmt.Sprintf("%s:%d", ListenIP, c.DiscoveryPort),
+	}
+	sent := 0
+	for _, t := range targets {
+		addr, err := net.ResolveUDPAddr("udp4", t)
+		if err != nil {
+			continue
+		}
+		if _, err := conn.WriteTo([]byte("alpacadiscovery1"), addr); err != nil {
+			log.Printf("Discovery packet to %s failed: %v", t, err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return nil, errors.New("unable to send discovery packet")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	found := make(map[string]AlpacaServer)
+	for {
+		buf := make([]byte, 1024)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			// Read deadline reached, no more replies expected
+			break
+		}
+		var reply discoveryReply
+		if err := json.Unmarshal(buf[:n], &reply); err != nil || reply.AlpacaPort == 0 {
+			continue
+		}
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			continue
+		}
+		key := fmt.Sprintf("%s:%d", host, reply.AlpacaPort)
+		found[key] = AlpacaServer{
+			Address: host,
+			Port:    reply.AlpacaPort,
+		}
+	}
+
+	var servers []AlpacaServer
+	for _, srv := range found {
+		srv.Devices, srv.Err = c.configuredDevices(srv.Address, srv.Port)
+		servers = append(servers, srv)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Address == servers[j].Address {
+			return servers[i].Port < servers[j].Port
+		}
+		return servers[i].Address < servers[j].Address
+	})
+	return servers, nil
+}
+
+// Query the management API of a discovered server for its configured devices
+func (c *DiscoveryClient) configuredDevices(address string, port uint32) ([]DeviceConfiguration, error) {
+	client := http.Client{Timeout: c.Timeout}
+	url := fmt.Sprintf("http://%s/management/v1/configureddevices", net.JoinHostPort(address, fmt.Sprint(port)))
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("configureddevices returned %s", resp.Status)
+	}
+	var list managementDevicesListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list.Value, nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -10,30 +9,30 @@ import (
 
 func (srv *ApiServer) configureFocuserAPI(router *httprouter.Router) {
 	// ASCOM Methods specifc to the Focuser API
-	router.GET("/setup/v1/focuser/1/setup", srv.handleFocuserSetup)
-	router.GET("/api/v1/focuser/1/absolute", srv.handleAbsolute)
-	router.GET("/api/v1/focuser/1/ismoving", srv.handleIsMoving)
-	router.GET("/api/v1/focuser/1/maxincrement", srv.handleMaxIncrement)
-	router.GET("/api/v1/focuser/1/maxstep", srv.handleMaxStep)
-	router.GET("/api/v1/focuser/1/position", srv.handlePosition)
-	router.GET("/api/v1/focuser/1/stepsize", srv.handleStepSize)
-	router.GET("/api/v1/focuser/1/tempcomp", srv.handleTempComp)
-	router.PUT("/api/v1/focuser/1/tempcomp", srv.handleNotSupported)
-	router.GET("/api/v1/focuser/1/tempcompavailable", srv.handleTempCompAvailable)
-	router.GET("/api/v1/focuser/1/temperature", srv.handleNotSupported)
-	router.PUT("/api/v1/focuser/1/halt", srv.handleHalt)
-	router.PUT("/api/v1/focuser/1/move", srv.handleMove)
+	router.GET("/setup/v1/focuser/:device_number/setup", srv.device(DeviceTypeFocuser, srv.handleFocuserSetup))
+	router.GET("/api/v1/focuser/:device_number/absolute", srv.device(DeviceTypeFocuser, srv.handleAbsolute))
+	router.GET("/api/v1/focuser/:device_number/ismoving", srv.device(DeviceTypeFocuser, srv.handleIsMoving))
+	router.GET("/api/v1/focuser/:device_number/maxincrement", srv.device(DeviceTypeFocuser, srv.handleMaxIncrement))
+	router.GET("/api/v1/focuser/:device_number/maxstep", srv.device(DeviceTypeFocuser, srv.handleMaxStep))
+	router.GET("/api/v1/focuser/:device_number/position", srv.device(DeviceTypeFocuser, srv.handlePosition))
+	router.GET("/api/v1/focuser/:device_number/stepsize", srv.device(DeviceTypeFocuser, srv.handleStepSize))
+	router.GET("/api/v1/focuser/:device_number/tempcomp", srv.device(DeviceTypeFocuser, srv.handleTempComp))
+	router.PUT("/api/v1/focuser/:device_number/tempcomp", srv.device(DeviceTypeFocuser, srv.handleNotSupported))
+	router.GET("/api/v1/focuser/:device_number/tempcompavailable", srv.device(DeviceTypeFocuser, srv.handleTempCompAvailable))
+	router.GET("/api/v1/focuser/:device_number/temperature", srv.device(DeviceTypeFocuser, srv.handleNotSupported))
+	router.PUT("/api/v1/focuser/:device_number/halt", srv.device(DeviceTypeFocuser, srv.handleHalt))
+	router.PUT("/api/v1/focuser/:device_number/move", srv.device(DeviceTypeFocuser, srv.handleMove))
 }
 
 // Handlers below are specific for the Focuser API
 
 // Setup page.
-func (srv *ApiServer) handleFocuserSetup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	fmt.Fprintln(w, "Alpaca MHP focuser server")
+func (srv *ApiServer) handleFocuserSetup(w http.ResponseWriter, r *http.Request, hub int) {
+	srv.writeSetupPage(w, r, "Alpaca MHP focuser server", hub)
 }
 
 // True if the focuser is capable of absolute position; that is, being commanded to a specific step location.
-func (srv *ApiServer) handleAbsolute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleAbsolute(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := booleanResponse{
 		Value: true,
 	}
@@ -44,7 +43,7 @@ func (srv *ApiServer) handleAbsolute(w http.ResponseWriter, r *http.Request, _ h
 }
 
 // True if the focuser is currently moving to a new position. False if the focuser is stationary.
-func (srv *ApiServer) handleIsMoving(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleIsMoving(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := booleanResponse{
 		Value: false, // JMC need to find a better way to determine if focuser is moving
 	}
@@ -55,9 +54,9 @@ func (srv *ApiServer) handleIsMoving(w http.ResponseWriter, r *http.Request, _ h
 }
 
 // Maximum increment size allowed by the focuser; i.e. the maximum number of steps allowed in one move operation.
-func (srv *ApiServer) handleMaxIncrement(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleMaxIncrement(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := int32Response{
-		Value: int32(MhpGetMaxIncrement()),
+		Value: int32(MhpGetMaxIncrement(hub)),
 	}
 	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
 	w.Header().Set("Content-Type", "application/json")
@@ -66,9 +65,9 @@ func (srv *ApiServer) handleMaxIncrement(w http.ResponseWriter, r *http.Request,
 }
 
 // Maximum step position permitted.
-func (srv *ApiServer) handleMaxStep(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (srv *ApiServer) handleMaxStep(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := int32Response{
-		Value: int32(MhpGetMaxStep()),
+		Value: int32(MhpGetMaxStep(hub)),
 	}
 	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
 	w.Header().Set("Content-Type", "application/json")
@@ -77,9 +76,9 @@ func (srv *ApiServer) handleMaxStep(w http.ResponseWriter, r *http.Request, ps h
 }
 
 // Current focuser position, in steps.
-func (srv *ApiServer) handlePosition(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handlePosition(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := int32Response{
-		Value: MhpGetPosition(),
+		Value: MhpGetPosition(hub),
 	}
 	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
 	w.Header().Set("Content-Type", "application/json")
@@ -88,7 +87,7 @@ func (srv *ApiServer) handlePosition(w http.ResponseWriter, r *http.Request, _ h
 }
 
 // Step size (microns) for the focuser
-func (srv *ApiServer) handleStepSize(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleStepSize(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := int32Response{
 		Value: 1, // JMC TODO
 	}
@@ -99,7 +98,7 @@ func (srv *ApiServer) handleStepSize(w http.ResponseWriter, r *http.Request, _ h
 }
 
 // Gets the state of temperature compensation mode (if available), else always False.
-func (srv *ApiServer) handleTempComp(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleTempComp(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := booleanResponse{
 		Value: false,
 	}
@@ -110,7 +109,7 @@ func (srv *ApiServer) handleTempComp(w http.ResponseWriter, r *http.Request, _ h
 }
 
 // True if focuser has temperature compensation available.
-func (srv *ApiServer) handleTempCompAvailable(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleTempCompAvailable(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := booleanResponse{
 		Value: false,
 	}
@@ -121,7 +120,7 @@ func (srv *ApiServer) handleTempCompAvailable(w http.ResponseWriter, r *http.Req
 }
 
 // Immediately stop any focuser motion due to a previous Move(Int32) method call.
-func (srv *ApiServer) handleHalt(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleHalt(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := stringResponse{
 		Value: "",
 	}
@@ -132,7 +131,7 @@ func (srv *ApiServer) handleHalt(w http.ResponseWriter, r *http.Request, _ httpr
 }
 
 // Moves the focuser by the specified amount or to the specified position depending on the value of the Absolute property.
-func (srv *ApiServer) handleMove(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleMove(w http.ResponseWriter, r *http.Request, hub int) {
 	value, err := getPositionFromRequest(r)
 	if err != nil {
 		resp := stringResponse{
@@ -146,7 +145,17 @@ func (srv *ApiServer) handleMove(w http.ResponseWriter, r *http.Request, _ httpr
 	}
 
 	// Move the focuser:
-	err = MhpMove(value)
+	err = MhpMove(hub, value, alpacaOrigin(r))
+	if isRefused(err) {
+		resp := putResponse{}
+		resp.ErrorNumber = errInvalidOperation
+		resp.ErrorMessage = err.Error()
+		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
 	if err != nil {
 		resp := stringResponse{
 			Value: err.Error(),
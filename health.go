@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Health endpoints for service managers and watchdogs. /healthz reports that the driver is
+// running and answering requests. /readyz checks what the driver needs to do its job: every
+// hub enumerates over USB, settings.json can be written and the discovery socket is bound.
+// Both answer 200 when all is well and 503 otherwise, with the result of each check.
+
+var startTime = time.Now()
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type healthResponse struct {
+	Status string        `json:"status"`
+	Uptime string        `json:"uptime"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+// Reports that the driver is running. Not part of the Alpaca standard.
+func (srv *ApiServer) handleHealthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeHealth(w, "ok", nil)
+}
+
+// Reports whether the driver is ready to serve clients. Not part of the Alpaca standard.
+func (srv *ApiServer) handleReadyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var checks []healthCheck
+	for hub, h := range hubs {
+		checks = append(checks, checkHidEnumerates(hub, h))
+	}
+	checks = append(checks, checkSettingsWritable(), srv.checkDiscoveryBound())
+
+	status := "ready"
+	for _, c := range checks {
+		if !c.OK {
+			status = "not ready"
+		}
+	}
+	writeHealth(w, status, checks)
+}
+
+func writeHealth(w http.ResponseWriter, status string, checks []healthCheck) {
+	resp := healthResponse{
+		Status: status,
+		Uptime: time.Since(startTime).Round(time.Second).String(),
+		Checks: checks,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status == "ok" || status == "ready" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// The hub is listed by the USB HID enumeration under the Mount Hub Pro vendor and product id
+func checkHidEnumerates(hub int, h *sw) healthCheck {
+	c := healthCheck{Name: fmt.Sprintf("hub %d usb", hub)}
+	info, err := h.hidFind()
+	if err != nil {
+		c.Detail = fmt.Sprintf("%s (vendor 0x%04x, product 0x%04x)", err, mhpVendorID, mhpProductID)
+		return c
+	}
+	c.OK = true
+	c.Detail = fmt.Sprintf("%s found at %s", h.hidName(), info.Path)
+	if info.Serial != "" {
+		c.Detail += ", serial " + info.Serial
+	}
+	return c
+}
+
+// settings.json can be opened for writing and a new file can be made next to it,
+// as writeFileAtomic does when the settings are saved
+func checkSettingsWritable() healthCheck {
+	c := healthCheck{Name: "settings writable"}
+	f, err := os.OpenFile(settingsFile, os.O_WRONLY, 0)
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	f.Close()
+	dir, err := filepath.Abs(filepath.Dir(settingsFile))
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	tmp, err := os.CreateTemp(dir, ".mhp-ready-*")
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	c.OK = true
+	c.Detail = filepath.Join(dir, settingsFile)
+	return c
+}
+
+func (srv *ApiServer) checkDiscoveryBound() healthCheck {
+	c := healthCheck{Name: "discovery"}
+	if srv.Discovery == nil || !srv.Discovery.Bound() {
+		c.Detail = "discovery socket is not bound"
+		return c
+	}
+	c.OK = true
+	c.Detail = "listening on " + srv.Discovery.ListenString
+	return c
+}
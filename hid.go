@@ -17,7 +17,11 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/karalabe/usb"
 )
@@ -26,11 +30,51 @@ const mhpVendorID = 0x12bf
 const mhpProductID = 0xff03
 const mhpMessageSize = 8
 
-func hidSend(message int64) (err error) {
+// Each hub is opened on first use and kept open until hidClose is called
+var hidMutex sync.Mutex
+
+// List every Mount Hub Pro plugged in to this computer
+func hidList() ([]usb.DeviceInfo, error) {
 	// Enumerate all the HID devices matching the MHP ID
 	hids, err := usb.EnumerateHid(mhpVendorID, mhpProductID)
 	if err != nil {
-		err = errors.New("mount hub pro not found")
+		return nil, errors.New("mount hub pro not found")
+	}
+	return hids, nil
+}
+
+// Describe how the hub is identified, for log messages
+func (s *sw) hidName() string {
+	sm.Lock()
+	defer sm.Unlock()
+	switch {
+	case s.Usbserial != "":
+		return "Mount Hub Pro with serial " + s.Usbserial
+	case s.Usbpath != "":
+		return "Mount Hub Pro at " + s.Usbpath
+	}
+	return "Mount Hub Pro"
+}
+
+// Find this hub among the connected devices, by serial number or USB path.
+// A hub with neither set matches the only connected hub.
+func (s *sw) hidFind() (info usb.DeviceInfo, err error) {
+	hids, err := hidList()
+	if err != nil {
+		return
+	}
+
+	sm.Lock()
+	serial, path := s.Usbserial, s.Usbpath
+	sm.Unlock()
+
+	for _, h := range hids {
+		if (serial != "" && h.Serial == serial) || (serial == "" && path != "" && h.Path == path) {
+			return h, nil
+		}
+	}
+	if serial != "" || path != "" {
+		err = fmt.Errorf("%s not found", s.hidName())
 		return
 	}
 
@@ -40,22 +84,66 @@ func hidSend(message int64) (err error) {
 	}
 
 	if len(hids) > 1 {
-		err = errors.New("only 1 Mount hub pro can be connected at the same time")
+		err = errors.New("more than one Mount Hub Pro is connected, set usbpath or usbserial for each hub in settings.json")
 		return
 	}
+	return hids[0], nil
+}
 
-	myhid := hids[0]
+// Report whether the hub is plugged in, without opening it
+func (s *sw) hidPresent() bool {
+	_, err := s.hidFind()
+	return err == nil
+}
+
+// Send a command to the hub and record it, with its HID report, in the audit log
+func (s *sw) hidSend(message int64, e auditEntry) (err error) {
+	start := time.Now()
 	bs := make([]byte, mhpMessageSize)
 
 	// note int64 is cast to uint64
 	binary.LittleEndian.PutUint64(bs, uint64(message))
+	e.Payload = hex.EncodeToString(bs)
+	defer func() {
+		metricsHidSend(e.Hub, time.Since(start), err)
+		if err != nil {
+			e.Error = err.Error()
+		}
+		auditRecord(e)
+	}()
+
+	hidMutex.Lock()
+	defer hidMutex.Unlock()
 
-	mydevice, err := myhid.Open()
+	if s.hid == nil {
+		info, err := s.hidFind()
+		if err != nil {
+			return err
+		}
+		s.hid, err = info.Open()
+		if err != nil {
+			s.hid = nil
+			return err
+		}
+	}
+
+	_, err = s.hid.Write(bs)
 	if err != nil {
+		// The hub may have been unplugged, open it again on the next send
+		s.hid.Close()
+		s.hid = nil
 		return
 	}
-	defer mydevice.Close()
-	mydevice.Write(bs)
 	// log.Printf("Command input: %x Little edian command sent: %x \n", message, bs)
 	return
 }
+
+// Release the hub so it can be used by another program
+func (s *sw) hidClose() {
+	hidMutex.Lock()
+	defer hidMutex.Unlock()
+	if s.hid != nil {
+		s.hid.Close()
+		s.hid = nil
+	}
+}
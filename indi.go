@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The INDI wire format, enough for the server in indiserver.go: properties are defined, set and
+// deleted with XML elements sent over TCP one after another without a root element, and clients
+// send getProperties and new...Vector elements back. See the INDI white paper,
+// https://www.clearskyinstitute.com/INDI/INDI.pdf
+
+// Property kinds
+const (
+	indiSwitch = "Switch"
+	indiNumber = "Number"
+	indiText   = "Text"
+)
+
+// Property states
+const (
+	indiOk    = "Ok"
+	indiBusy  = "Busy"
+	indiAlert = "Alert"
+)
+
+const (
+	indiOn  = "On"
+	indiOff = "Off"
+)
+
+type indiElement struct {
+	name  string
+	label string
+	value string // On or Off for a switch, the number or the text
+	// Numbers only
+	format string // printf style, e.g. %.0f
+	min    float64
+	max    float64
+	step   float64
+}
+
+type indiProperty struct {
+	device   string
+	name     string
+	label    string
+	group    string
+	kind     string // Switch, Number or Text
+	perm     string // ro or rw
+	rule     string // switches only, e.g. OneOfMany
+	state    string
+	elements []indiElement
+}
+
+func indiNumberValue(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
+
+func indiSwitchValue(on bool) string {
+	if on {
+		return indiOn
+	}
+	return indiOff
+}
+
+// Report whether p and q are defined the same way, whatever their values and state
+func (p *indiProperty) sameDefinition(q *indiProperty) bool {
+	if p.label != q.label || p.group != q.group || p.kind != q.kind || p.perm != q.perm ||
+		p.rule != q.rule || len(p.elements) != len(q.elements) {
+		return false
+	}
+	for i, e := range p.elements {
+		f := q.elements[i]
+		if e.name != f.name || e.label != f.label || e.format != f.format || e.min != f.min || e.max != f.max || e.step != f.step {
+			return false
+		}
+	}
+	return true
+}
+
+// Report whether the elements of p and q, defined the same way, have the same values
+func (p *indiProperty) sameValues(q *indiProperty) bool {
+	for i, e := range p.elements {
+		if e.value != q.elements[i].value {
+			return false
+		}
+	}
+	return true
+}
+
+func indiTimestamp() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05")
+}
+
+func writeIndiAttr(b *strings.Builder, name string, value string) {
+	b.WriteString(" ")
+	b.WriteString(name)
+	b.WriteString(`="`)
+	xml.EscapeText(b, []byte(value))
+	b.WriteString(`"`)
+}
+
+func formatIndiFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Write a def...Vector element defining p
+func (p *indiProperty) writeDef(b *strings.Builder, timestamp string) {
+	b.WriteString("<def" + p.kind + "Vector")
+	writeIndiAttr(b, "device", p.device)
+	writeIndiAttr(b, "name", p.name)
+	writeIndiAttr(b, "label", p.label)
+	writeIndiAttr(b, "group", p.group)
+	writeIndiAttr(b, "state", p.state)
+	writeIndiAttr(b, "perm", p.perm)
+	if p.kind == indiSwitch {
+		writeIndiAttr(b, "rule", p.rule)
+	}
+	writeIndiAttr(b, "timeout", "60")
+	writeIndiAttr(b, "timestamp", timestamp)
+	b.WriteString(">\n")
+	for _, e := range p.elements {
+		b.WriteString("  <def" + p.kind)
+		writeIndiAttr(b, "name", e.name)
+		writeIndiAttr(b, "label", e.label)
+		if p.kind == indiNumber {
+			writeIndiAttr(b, "format", e.format)
+			writeIndiAttr(b, "min", formatIndiFloat(e.min))
+			writeIndiAttr(b, "max", formatIndiFloat(e.max))
+			writeIndiAttr(b, "step", formatIndiFloat(e.step))
+		}
+		b.WriteString(">")
+		xml.EscapeText(b, []byte(e.value))
+		b.WriteString("</def" + p.kind + ">\n")
+	}
+	b.WriteString("</def" + p.kind + "Vector>\n")
+}
+
+// Write a set...Vector element with the state and values of p, and message if it is not empty
+func (p *indiProperty) writeSet(b *strings.Builder, timestamp string, message string) {
+	b.WriteString("<set" + p.kind + "Vector")
+	writeIndiAttr(b, "device", p.device)
+	writeIndiAttr(b, "name", p.name)
+	writeIndiAttr(b, "state", p.state)
+	writeIndiAttr(b, "timestamp", timestamp)
+	if message != "" {
+		writeIndiAttr(b, "message", message)
+	}
+	b.WriteString(">\n")
+	for _, e := range p.elements {
+		b.WriteString("  <one" + p.kind)
+		writeIndiAttr(b, "name", e.name)
+		b.WriteString(">")
+		xml.EscapeText(b, []byte(e.value))
+		b.WriteString("</one" + p.kind + ">\n")
+	}
+	b.WriteString("</set" + p.kind + "Vector>\n")
+}
+
+func writeIndiDel(b *strings.Builder, device string, name string, timestamp string) {
+	b.WriteString("<delProperty")
+	writeIndiAttr(b, "device", device)
+	writeIndiAttr(b, "name", name)
+	writeIndiAttr(b, "timestamp", timestamp)
+	b.WriteString("/>\n")
+}
+
+func writeIndiMessage(b *strings.Builder, device string, timestamp string, message string) {
+	b.WriteString("<message")
+	writeIndiAttr(b, "device", device)
+	writeIndiAttr(b, "timestamp", timestamp)
+	writeIndiAttr(b, "message", message)
+	b.WriteString("/>\n")
+}
+
+// An element sent by a client: getProperties, enableBLOB or new...Vector
+type indiCommand struct {
+	XMLName  xml.Name
+	Device   string               `xml:"device,attr"`
+	Name     string               `xml:"name,attr"`
+	Elements []indiCommandElement `xml:",any"`
+}
+
+// oneSwitch, oneNumber or oneText in a new...Vector
+type indiCommandElement struct {
+	XMLName xml.Name
+	Name    string `xml:"name,attr"`
+	Value   string `xml:",chardata"`
+}
+
+// Read the next element sent by a client
+func readIndiCommand(d *xml.Decoder) (cmd indiCommand, err error) {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return cmd, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			err = d.DecodeElement(&cmd, &start)
+			return cmd, err
+		}
+	}
+}
+
+func (cmd *indiCommand) value(name string) (string, bool) {
+	for _, e := range cmd.Elements {
+		if e.Name == name {
+			return strings.TrimSpace(e.Value), true
+		}
+	}
+	return "", false
+}
+
+// The state chosen by a new switch vector with a pair of OneOfMany switches, such as CONNECT
+// and DISCONNECT. Clients may send only the switch turned on.
+func (cmd *indiCommand) choice(on string, off string) (bool, bool) {
+	if v, ok := cmd.value(on); ok {
+		return v == indiOn, true
+	}
+	if v, ok := cmd.value(off); ok {
+		return v != indiOn, true
+	}
+	return false, false
+}
+
+// The value of a number element of a new number vector
+func (cmd *indiCommand) number(name string) (float64, error) {
+	v, ok := cmd.value(name)
+	if !ok {
+		return 0, fmt.Errorf("%s: %s missing", cmd.Name, name)
+	}
+	return strconv.ParseFloat(v, 64)
+}
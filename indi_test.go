@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadIndiCommand(t *testing.T) {
+	stream := `<getProperties version="1.7"/>
+<newSwitchVector device="Mount Hub Pro" name="POWER_PORT_3" timestamp="2026-03-14T21:30:00">
+  <oneSwitch name="ON">
+    On
+  </oneSwitch>
+</newSwitchVector>
+<enableBLOB device="Mount Hub Pro">Never</enableBLOB>
+<newNumberVector device="Mount Hub Pro Focuser" name="ABS_FOCUS_POSITION">
+  <oneNumber name="FOCUS_ABSOLUTE_POSITION"> 1200.4 </oneNumber>
+</newNumberVector>
+`
+	d := xml.NewDecoder(strings.NewReader(stream))
+
+	cmd, err := readIndiCommand(d)
+	if err != nil || cmd.XMLName.Local != "getProperties" || cmd.Device != "" || cmd.Name != "" {
+		t.Fatalf("getProperties: %+v, %v", cmd, err)
+	}
+
+	cmd, err = readIndiCommand(d)
+	if err != nil || cmd.XMLName.Local != "newSwitchVector" || cmd.Device != "Mount Hub Pro" || cmd.Name != "POWER_PORT_3" {
+		t.Fatalf("newSwitchVector: %+v, %v", cmd, err)
+	}
+	if on, ok := cmd.choice("ON", "OFF"); !on || !ok {
+		t.Errorf("choice(ON, OFF) = %v, %v, want true, true", on, ok)
+	}
+	if _, ok := cmd.choice("CONNECT", "DISCONNECT"); ok {
+		t.Error("choice(CONNECT, DISCONNECT) found a switch that was not sent")
+	}
+
+	cmd, err = readIndiCommand(d)
+	if err != nil || cmd.XMLName.Local != "enableBLOB" {
+		t.Fatalf("enableBLOB: %+v, %v", cmd, err)
+	}
+
+	cmd, err = readIndiCommand(d)
+	if err != nil || cmd.XMLName.Local != "newNumberVector" {
+		t.Fatalf("newNumberVector: %+v, %v", cmd, err)
+	}
+	if v, err := cmd.number("FOCUS_ABSOLUTE_POSITION"); v != 1200.4 || err != nil {
+		t.Errorf("number = %v, %v, want 1200.4", v, err)
+	}
+	if _, err := cmd.number("FOCUS_RELATIVE_POSITION"); err == nil {
+		t.Error("number of a missing element: no error")
+	}
+
+	if _, err := readIndiCommand(d); err != io.EOF {
+		t.Errorf("at the end: %v, want EOF", err)
+	}
+}
+
+func TestIndiChoice(t *testing.T) {
+	tests := []struct {
+		elements []indiCommandElement
+		want     bool
+		wantOk   bool
+	}{
+		{[]indiCommandElement{{Name: "CONNECT", Value: "On"}, {Name: "DISCONNECT", Value: "Off"}}, true, true},
+		{[]indiCommandElement{{Name: "CONNECT", Value: "Off"}, {Name: "DISCONNECT", Value: "On"}}, false, true},
+		{[]indiCommandElement{{Name: "DISCONNECT", Value: "On"}}, false, true}, // only the switch turned on
+		{[]indiCommandElement{{Name: "DISCONNECT", Value: "Off"}}, true, true},
+		{nil, false, false},
+	}
+	for _, tt := range tests {
+		cmd := indiCommand{Name: "CONNECTION", Elements: tt.elements}
+		if got, ok := cmd.choice("CONNECT", "DISCONNECT"); got != tt.want || ok != tt.wantOk {
+			t.Errorf("choice of %+v = %v, %v, want %v, %v", tt.elements, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func testIndiProperty(name string, value string) indiProperty {
+	return indiProperty{
+		device: "Mount Hub Pro", name: name, label: name, group: "Main Control",
+		kind: indiNumber, perm: "rw", state: indiOk,
+		elements: []indiElement{{name: "VALUE", label: "Value", value: value, format: "%.0f", max: 100, step: 1}},
+	}
+}
+
+func TestIndiChanges(t *testing.T) {
+	const ts = "2026-03-14T21:30:00"
+	a, b := testIndiProperty("A", "1"), testIndiProperty("B", "2")
+	busy := a
+	busy.state = indiBusy
+	changed := a
+	changed.elements = []indiElement{a.elements[0]}
+	changed.elements[0].value = "5"
+	redefined := a
+	redefined.elements = []indiElement{a.elements[0]}
+	redefined.elements[0].max = 200
+	failed := errors.New("switch 4 is interlocked")
+
+	tests := []struct {
+		name    string
+		last    []indiProperty
+		props   []indiProperty
+		done    *indiProperty
+		message string
+		err     error
+		want    []string // in order
+		wantNot []string
+	}{
+		{name: "unchanged", last: []indiProperty{a, b}, props: []indiProperty{a, b}},
+		{
+			name: "defined", last: []indiProperty{a}, props: []indiProperty{a, b},
+			want: []string{`<defNumberVector device="Mount Hub Pro" name="B"`}, wantNot: []string{`name="A"`},
+		},
+		{
+			name: "deleted", last: []indiProperty{a, b}, props: []indiProperty{a},
+			want: []string{`<delProperty device="Mount Hub Pro" name="B" timestamp="` + ts + `"/>`}, wantNot: []string{`name="A"`},
+		},
+		{
+			name: "redefined", last: []indiProperty{a}, props: []indiProperty{redefined},
+			want: []string{`<delProperty device="Mount Hub Pro" name="A"`, `<defNumberVector device="Mount Hub Pro" name="A"`, `max="200"`},
+		},
+		{
+			name: "value", last: []indiProperty{a}, props: []indiProperty{changed},
+			want: []string{`<setNumberVector device="Mount Hub Pro" name="A" state="Ok"`, `<oneNumber name="VALUE">5</oneNumber>`},
+		},
+		{
+			name: "state", last: []indiProperty{busy}, props: []indiProperty{a},
+			want: []string{`<setNumberVector device="Mount Hub Pro" name="A" state="Ok"`},
+		},
+		{
+			name: "done unchanged", last: []indiProperty{a, b}, props: []indiProperty{a, b}, done: &a,
+			want: []string{`<setNumberVector device="Mount Hub Pro" name="A" state="Ok"`}, wantNot: []string{`name="B"`},
+		},
+		{
+			name: "done with message", last: []indiProperty{a}, props: []indiProperty{a}, done: &a, message: "stopped at 0, the end of travel",
+			want: []string{`state="Ok" timestamp="` + ts + `" message="stopped at 0, the end of travel"`},
+		},
+		{
+			name: "done busy", last: []indiProperty{a}, props: []indiProperty{busy}, done: &a,
+			want: []string{`name="A" state="Busy"`},
+		},
+		{
+			name: "done failed", last: []indiProperty{a}, props: []indiProperty{a}, done: &a, message: "ignored", err: failed,
+			want: []string{`name="A" state="Alert" timestamp="` + ts + `" message="switch 4 is interlocked"`}, wantNot: []string{"ignored"},
+		},
+	}
+	for _, tt := range tests {
+		props := append([]indiProperty(nil), tt.props...)
+		got := indiChanges(tt.last, props, tt.done, tt.message, tt.err, ts)
+		if len(tt.want) == 0 && got != "" {
+			t.Errorf("%s: sent %q, want nothing", tt.name, got)
+		}
+		rest := got
+		for _, w := range tt.want {
+			i := strings.Index(rest, w)
+			if i < 0 {
+				t.Errorf("%s: %q not in %q", tt.name, w, got)
+				break
+			}
+			rest = rest[i+len(w):]
+		}
+		for _, w := range tt.wantNot {
+			if strings.Contains(got, w) {
+				t.Errorf("%s: %q in %q", tt.name, w, got)
+			}
+		}
+		// What is kept for the next comparison is the state of the hub, not the reply
+		for i := range props {
+			if props[i].state != tt.props[i].state {
+				t.Errorf("%s: %s kept as %s, want %s", tt.name, props[i].name, props[i].state, tt.props[i].state)
+			}
+		}
+	}
+}
+
+// An INDI server on a hub at focuser position 1000 of 2000, with its changes recorded in calls
+func testINDIServer(t *testing.T) (*indiServer, *sw, chan bridgeCall) {
+	saved := hubs
+	h := new(sw)
+	h.mhpsetdefaults()
+	h.Focucerposition = 1000
+	h.Focusermaxstep = 2000
+	hubs = []*sw{h}
+	t.Cleanup(func() { hubs = saved })
+
+	calls := make(chan bridgeCall, 10)
+	srv := newINDIServer(nil)
+	srv.setOnOff = func(hub int, id int32, state bool, o changeOrigin) error {
+		value := int64(0)
+		if state {
+			value = 1
+		}
+		calls <- bridgeCall{"onoff", hub, id, value, o}
+		return nil
+	}
+	srv.setValue = func(hub int, id int32, value int64, o changeOrigin) error {
+		calls <- bridgeCall{"value", hub, id, value, o}
+		return nil
+	}
+	srv.move = func(hub int, value int32, o changeOrigin) error {
+		calls <- bridgeCall{"move", hub, 0, int64(value), o}
+		return nil
+	}
+	return srv, h, calls
+}
+
+func indiElements(pairs ...string) []indiCommandElement {
+	var elements []indiCommandElement
+	for i := 0; i+1 < len(pairs); i += 2 {
+		elements = append(elements, indiCommandElement{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return elements
+}
+
+func TestIndiApply(t *testing.T) {
+	srv, _, calls := testINDIServer(t)
+	power, focuser := srv.devices[0], srv.devices[1]
+	a, b := newINDIClient(nil, "10.0.0.2"), newINDIClient(nil, "10.0.0.3")
+	a.id, b.id = 1, 2
+
+	tests := []struct {
+		name    string
+		c       *indiClient
+		dev     *indiDevice
+		prop    string
+		pairs   []string
+		want    *bridgeCall // with the origin left out
+		message string
+		wantErr bool
+	}{
+		{name: "port", c: a, dev: power, prop: "POWER_PORT_3", pairs: []string{"ON", "On"}, want: &bridgeCall{"onoff", 0, 3, 1, changeOrigin{}}},
+		{name: "port off only", c: b, dev: power, prop: "POWER_PORT_5", pairs: []string{"OFF", "On"}, want: &bridgeCall{"onoff", 0, 5, 0, changeOrigin{}}},
+		{name: "port neither", c: a, dev: power, prop: "POWER_PORT_5", pairs: []string{"AUTO", "On"}, wantErr: true},
+		{name: "heater", c: a, dev: power, prop: "DEW_HEATER_2", pairs: []string{"LEVEL", "40.4"}, want: &bridgeCall{"value", 0, NumOnOffSwitch + 2, 40, changeOrigin{}}},
+		{name: "heater not a number", c: a, dev: power, prop: "DEW_HEATER_2", pairs: []string{"LEVEL", "warm"}, wantErr: true},
+		{name: "power unknown", c: a, dev: power, prop: "ABS_FOCUS_POSITION", pairs: []string{"FOCUS_ABSOLUTE_POSITION", "10"}, wantErr: true},
+		{name: "absolute", c: a, dev: focuser, prop: "ABS_FOCUS_POSITION", pairs: []string{"FOCUS_ABSOLUTE_POSITION", "1200"}, want: &bridgeCall{"move", 0, 0, 1200, changeOrigin{}}},
+		{name: "absolute in place", c: a, dev: focuser, prop: "ABS_FOCUS_POSITION", pairs: []string{"FOCUS_ABSOLUTE_POSITION", "1000"}},
+		// Relative moves are inward until the client chooses otherwise, each client on its own
+		{name: "a inward", c: a, dev: focuser, prop: "REL_FOCUS_POSITION", pairs: []string{"FOCUS_RELATIVE_POSITION", "100"}, want: &bridgeCall{"move", 0, 0, 900, changeOrigin{}}},
+		{name: "a outward", c: a, dev: focuser, prop: "FOCUS_MOTION", pairs: []string{"FOCUS_OUTWARD", "On"}},
+		{name: "a out", c: a, dev: focuser, prop: "REL_FOCUS_POSITION", pairs: []string{"FOCUS_RELATIVE_POSITION", "100"}, want: &bridgeCall{"move", 0, 0, 1100, changeOrigin{}}},
+		{name: "b still in", c: b, dev: focuser, prop: "REL_FOCUS_POSITION", pairs: []string{"FOCUS_RELATIVE_POSITION", "100"}, want: &bridgeCall{"move", 0, 0, 900, changeOrigin{}}},
+		{name: "b zero", c: b, dev: focuser, prop: "REL_FOCUS_POSITION", pairs: []string{"FOCUS_RELATIVE_POSITION", "0"}},
+		{name: "a past the end", c: a, dev: focuser, prop: "REL_FOCUS_POSITION", pairs: []string{"FOCUS_RELATIVE_POSITION", "1500"}, want: &bridgeCall{"move", 0, 0, 2000, changeOrigin{}}, message: "stopped at 2000, the end of travel"},
+		{name: "b past the start", c: b, dev: focuser, prop: "REL_FOCUS_POSITION", pairs: []string{"FOCUS_RELATIVE_POSITION", "1500"}, want: &bridgeCall{"move", 0, 0, 0, changeOrigin{}}, message: "stopped at 0, the end of travel"},
+		{name: "direction missing", c: b, dev: focuser, prop: "FOCUS_MOTION", wantErr: true},
+		{name: "focuser unknown", c: b, dev: focuser, prop: "POWER_PORT_3", pairs: []string{"ON", "On"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		cmd := indiCommand{Device: tt.dev.name, Name: tt.prop, Elements: indiElements(tt.pairs...)}
+		o := changeOrigin{Source: SourceINDI, ClientID: tt.c.id, Address: tt.c.address}
+		message, err := srv.apply(tt.c, tt.dev, cmd, o)
+		if (err != nil) != tt.wantErr || message != tt.message {
+			t.Errorf("%s: %q, %v, want %q and an error %v", tt.name, message, err, tt.message, tt.wantErr)
+		}
+		select {
+		case call := <-calls:
+			if tt.want == nil {
+				t.Errorf("%s: unexpected %+v", tt.name, call)
+				continue
+			}
+			if call.o != o {
+				t.Errorf("%s: origin %+v, want %+v", tt.name, call.o, o)
+			}
+			call.o = changeOrigin{}
+			if call != *tt.want {
+				t.Errorf("%s: %+v, want %+v", tt.name, call, *tt.want)
+			}
+		default:
+			if tt.want != nil {
+				t.Errorf("%s: no change, want %+v", tt.name, *tt.want)
+			}
+		}
+	}
+}
+
+func TestIndiApplyAtEndOfTravel(t *testing.T) {
+	srv, h, calls := testINDIServer(t)
+	h.Focucerposition = 0
+	c := newINDIClient(nil, "10.0.0.2")
+	cmd := indiCommand{Name: "REL_FOCUS_POSITION", Elements: indiElements("FOCUS_RELATIVE_POSITION", "10")}
+	if _, err := srv.apply(c, srv.devices[1], cmd, changeOrigin{Source: SourceINDI}); err == nil {
+		t.Error("moving in from 0: no error")
+	}
+	if len(calls) != 0 {
+		t.Errorf("moved from the end of travel: %+v", <-calls)
+	}
+}
+
+func TestIndiConnectionPerClient(t *testing.T) {
+	srv, _, _ := testINDIServer(t)
+	a, b := newINDIClient(nil, "10.0.0.2"), newINDIClient(nil, "10.0.0.3")
+	focuser := srv.devices[1]
+	connect := indiCommand{Name: "CONNECTION", Elements: indiElements("CONNECT", "On")}
+	outward := indiCommand{Name: "FOCUS_MOTION", Elements: indiElements("FOCUS_OUTWARD", "On")}
+	for _, cmd := range []indiCommand{connect, outward} {
+		if _, err := srv.apply(a, focuser, cmd, changeOrigin{Source: SourceINDI}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	find := func(props []indiProperty, name string) *indiProperty {
+		for i := range props {
+			if props[i].device == focuser.name && props[i].name == name {
+				return &props[i]
+			}
+		}
+		return nil
+	}
+	states := srv.snapshots()
+	if p := find(srv.properties(states, b), "FOCUS_MOTION"); p != nil {
+		t.Error("FOCUS_MOTION defined for a client that did not connect")
+	}
+	p := find(srv.properties(states, a), "FOCUS_MOTION")
+	if p == nil || p.elements[1].value != indiOn {
+		t.Fatalf("FOCUS_MOTION of the client that chose outward: %+v", p)
+	}
+	if _, err := srv.apply(b, focuser, connect, changeOrigin{Source: SourceINDI}); err != nil {
+		t.Fatal(err)
+	}
+	if p := find(srv.properties(states, b), "FOCUS_MOTION"); p == nil || p.elements[0].value != indiOn {
+		t.Errorf("FOCUS_MOTION of another client: %+v", p)
+	}
+}
+
+func TestIndiFocuserBusyWhileMoving(t *testing.T) {
+	srv, h, _ := testINDIServer(t)
+	c := newINDIClient(nil, "10.0.0.2")
+	c.connected[srv.devices[1].name] = true
+	state := func(name string) string {
+		for _, p := range srv.properties(srv.snapshots(), c) {
+			if p.device == srv.devices[1].name && p.name == name {
+				return p.state
+			}
+		}
+		return ""
+	}
+
+	h.moveEnds = time.Now().Add(time.Minute)
+	if abs, rel := state("ABS_FOCUS_POSITION"), state("REL_FOCUS_POSITION"); abs != indiBusy || rel != indiBusy {
+		t.Errorf("while moving: %s and %s, want Busy", abs, rel)
+	}
+	if motion := state("FOCUS_MOTION"); motion != indiOk {
+		t.Errorf("FOCUS_MOTION while moving: %s, want Ok", motion)
+	}
+	h.moveEnds = time.Now().Add(-time.Millisecond)
+	if abs, rel := state("ABS_FOCUS_POSITION"), state("REL_FOCUS_POSITION"); abs != indiOk || rel != indiOk {
+		t.Errorf("once arrived: %s and %s, want Ok", abs, rel)
+	}
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// INDI server for KStars/Ekos and other INDI clients, turned on by creating indi.json. Each hub
+// is served as a power box device, with a switch vector for each power port and a number vector
+// for each dew heater, and as a focuser device. Changes from INDI clients go through
+// MhpSetOnOff, MhpSetValue and MhpMove like those of Alpaca clients, and changes made any other
+// way are sent to the INDI clients within a second, so both protocols can be used at once.
+
+const indiFile = "indi.json"
+const indiStateInterval = time.Second
+const indiWriteTimeout = 10 * time.Second
+const indiQueueLength = 64 // updates waiting to be written to a client before it is dropped
+
+const SourceINDI = "indi"
+
+// Values of DRIVER_INTERFACE in DRIVER_INFO, telling clients what kind of device it is
+const (
+	indiFocuserInterface = 1 << 3
+	indiAuxInterface     = 1 << 15
+)
+
+type indiConfig struct {
+	Listen string `json:"listen"` // address to listen on, e.g. :7624 for every interface
+}
+
+func defaultINDIConfig() indiConfig {
+	return indiConfig{Listen: ":7624"}
+}
+
+// Read indi.json. ok is false if there is no such file, the server is then off.
+func loadINDIConfig() (c indiConfig, ok bool, err error) {
+	data, err := os.ReadFile(indiFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, err
+	}
+	c = defaultINDIConfig()
+	if p, ok := decodeStrict(indiFile, data, &c); !ok {
+		return c, false, p
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return c, false, fmt.Errorf("%s: listen must be an address such as :7624, found %q", indiFile, c.Listen)
+	}
+	return c, true, nil
+}
+
+// A device served over INDI, the power box or the focuser of a hub
+type indiDevice struct {
+	name    string
+	hub     int
+	focuser bool
+}
+
+// A connected INDI client. Each client connects to each device on its own, as with Alpaca, so
+// one client disconnecting leaves the others connected.
+type indiClient struct {
+	conn      net.Conn
+	address   string          // host of the client, without the port
+	id        uint32          // ClientID of its changes, so that it can confirm a critical port by repeating
+	out       chan string     // written to the client by write, see send
+	dropped   bool            // did not keep up with out and has been disconnected
+	watching  bool            // has sent getProperties, so is sent changes
+	connected map[string]bool // devices connected by this client, by name; the properties beyond
+	// CONNECTION and DRIVER_INFO are only defined while connected
+	outward  map[string]bool  // direction of relative focuser moves, by device name
+	relative map[string]int32 // steps of the last relative focuser move, by device name
+	last     []indiProperty   // as last sent to this client
+}
+
+type indiServer struct {
+	sync.Mutex // held while properties are compared and queued, so every client sees changes in order
+	listener   net.Listener
+	devices    []*indiDevice
+	clients    map[*indiClient]bool
+	lastID     uint32 // of the last client to connect, numbered from 1
+	closed     bool   // shutting down, new clients are turned away
+	wg         sync.WaitGroup
+	// How changes are made, replaced in tests
+	setOnOff func(hub int, id int32, state bool, o changeOrigin) error
+	setValue func(hub int, id int32, value int64, o changeOrigin) error
+	move     func(hub int, value int32, o changeOrigin) error
+}
+
+// Serve INDI clients in the background if indi.json exists. The returned channel is closed
+// once the server has stopped after ctx is cancelled.
+func MhpStartINDI(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	config, ok, err := loadINDIConfig()
+	if err != nil {
+		log.Println("INDI server not started:", err)
+	}
+	if !ok {
+		close(done)
+		return done
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		log.Println("INDI server not started:", err)
+		close(done)
+		return done
+	}
+	log.Println("INDI server listening on", listener.Addr())
+
+	srv := newINDIServer(listener)
+	go func() {
+		defer close(done)
+		srv.run(ctx)
+	}()
+	return done
+}
+
+func newINDIServer(listener net.Listener) *indiServer {
+	srv := &indiServer{
+		listener: listener, clients: make(map[*indiClient]bool),
+		setOnOff: MhpSetOnOff, setValue: MhpSetValue, move: MhpMove,
+	}
+	for hub := range hubs {
+		power, focuser := indiDeviceNames(hub)
+		srv.devices = append(srv.devices, &indiDevice{name: power, hub: hub}, &indiDevice{name: focuser, hub: hub, focuser: true})
+	}
+	return srv
+}
+
+// The names of the devices of a hub, numbered when there is more than one hub
+func indiDeviceNames(hub int) (power string, focuser string) {
+	power, focuser = "Mount Hub Pro", "Mount Hub Pro Focuser"
+	if len(hubs) > 1 {
+		power += " " + strconv.Itoa(hub)
+		focuser += " " + strconv.Itoa(hub)
+	}
+	return
+}
+
+func (srv *indiServer) run(ctx context.Context) {
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		for {
+			conn, err := srv.listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("INDI server stopped:", err)
+				}
+				return
+			}
+			srv.wg.Add(1)
+			go func() {
+				defer srv.wg.Done()
+				srv.serve(conn)
+			}()
+		}
+	}()
+
+	ticker := time.NewTicker(indiStateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			srv.listener.Close()
+			srv.Lock()
+			srv.closed = true
+			for c := range srv.clients {
+				c.conn.Close()
+			}
+			srv.Unlock()
+			srv.wg.Wait()
+			return
+		case <-ticker.C:
+			srv.publish(nil, nil, "", nil)
+		}
+	}
+}
+
+func newINDIClient(conn net.Conn, address string) *indiClient {
+	return &indiClient{
+		conn: conn, address: address, out: make(chan string, indiQueueLength),
+		connected: make(map[string]bool), outward: make(map[string]bool), relative: make(map[string]int32),
+	}
+}
+
+// Read the commands of a client until it goes away
+func (srv *indiServer) serve(conn net.Conn) {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	c := newINDIClient(conn, host)
+	srv.Lock()
+	if srv.closed {
+		srv.Unlock()
+		conn.Close()
+		return
+	}
+	srv.lastID++
+	c.id = srv.lastID
+	srv.clients[c] = true
+	srv.Unlock()
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		c.write()
+	}()
+	defer func() {
+		srv.Lock()
+		delete(srv.clients, c)
+		close(c.out)
+		srv.Unlock()
+		conn.Close()
+	}()
+
+	d := xml.NewDecoder(conn)
+	for {
+		cmd, err := readIndiCommand(d)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Println("INDI client", conn.RemoteAddr(), "dropped:", err)
+			}
+			return
+		}
+		srv.handle(c, cmd)
+	}
+}
+
+// Queue data for a client without waiting for it to be written, so that a slow client does not
+// hold up the others. A client whose queue is full is not keeping up and is dropped. Caller
+// holds srv.
+func (srv *indiServer) send(c *indiClient, data string) {
+	if c.dropped {
+		return
+	}
+	select {
+	case c.out <- data:
+	default:
+		c.dropped = true
+		log.Println("INDI client", c.conn.RemoteAddr(), "dropped: not keeping up")
+		// The read loop ends and removes the client
+		c.conn.Close()
+	}
+}
+
+// Write what is queued for the client until the queue is closed by serve. Once a write fails the
+// rest is discarded.
+func (c *indiClient) write() {
+	failed := false
+	for data := range c.out {
+		if failed {
+			continue
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(indiWriteTimeout))
+		if _, err := io.WriteString(c.conn, data); err != nil {
+			// The read loop ends and removes the client
+			failed = true
+			c.conn.Close()
+		}
+	}
+}
+
+// The outputs and limits of every hub as they are now
+func (srv *indiServer) snapshots() []hubState {
+	states := make([]hubState, len(hubs))
+	for hub, h := range hubs {
+		states[hub] = h.snapshot()
+	}
+	return states
+}
+
+// The properties of every device for client c, given the hubs as they are now. Caller holds srv.
+func (srv *indiServer) properties(states []hubState, c *indiClient) []indiProperty {
+	var props []indiProperty
+	for _, dev := range srv.devices {
+		st := &states[dev.hub]
+		if dev.focuser {
+			props = append(props, dev.focuserProperties(st, c.connected[dev.name], c.outward[dev.name], c.relative[dev.name])...)
+		} else {
+			props = append(props, dev.powerProperties(st, c.connected[dev.name])...)
+		}
+	}
+	return props
+}
+
+// CONNECTION and DRIVER_INFO, which every INDI device has
+func (dev *indiDevice) commonProperties(driverInterface int, connected bool) []indiProperty {
+	version := ""
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		version = bi.Main.Version
+	}
+	return []indiProperty{
+		{
+			device: dev.name, name: "CONNECTION", label: "Connection", group: "Main Control",
+			kind: indiSwitch, perm: "rw", rule: "OneOfMany", state: indiOk,
+			elements: []indiElement{
+				{name: "CONNECT", label: "Connect", value: indiSwitchValue(connected)},
+				{name: "DISCONNECT", label: "Disconnect", value: indiSwitchValue(!connected)},
+			},
+		},
+		{
+			device: dev.name, name: "DRIVER_INFO", label: "Driver Info", group: "General Info",
+			kind: indiText, perm: "ro", state: indiOk,
+			elements: []indiElement{
+				{name: "DRIVER_NAME", label: "Name", value: "Mount Hub Pro"},
+				{name: "DRIVER_EXEC", label: "Exec", value: "mhp"},
+				{name: "DRIVER_VERSION", label: "Version", value: version},
+				{name: "DRIVER_INTERFACE", label: "Interface", value: strconv.Itoa(driverInterface)},
+			},
+		},
+	}
+}
+
+func indiPerm(canWrite bool) string {
+	if canWrite {
+		return "rw"
+	}
+	return "ro"
+}
+
+// POWER_PORT_1 to 8 and DEW_HEATER_1 to 4
+func (dev *indiDevice) powerProperties(st *hubState, connected bool) []indiProperty {
+	props := dev.commonProperties(indiAuxInterface, connected)
+	if !connected {
+		return props
+	}
+	for id := int32(1); id <= NumOnOffSwitch; id++ {
+		on := st.values[id] != 0
+		props = append(props, indiProperty{
+			device: dev.name, name: fmt.Sprintf("POWER_PORT_%d", id), label: st.names[id], group: "Power",
+			kind: indiSwitch, perm: indiPerm(st.canWrite[id]), rule: "OneOfMany", state: indiOk,
+			elements: []indiElement{
+				{name: "ON", label: "On", value: indiSwitchValue(on)},
+				{name: "OFF", label: "Off", value: indiSwitchValue(!on)},
+			},
+		})
+	}
+	for n := int32(1); n <= NumVarSwitch; n++ {
+		id := NumOnOffSwitch + n
+		props = append(props, indiProperty{
+			device: dev.name, name: fmt.Sprintf("DEW_HEATER_%d", n), label: st.names[id], group: "Dew",
+			kind: indiNumber, perm: indiPerm(st.canWrite[id] && !st.automatic[n-1]), state: indiOk,
+			elements: []indiElement{{
+				name: "LEVEL", label: "Power (%)", value: indiNumberValue(st.values[id]), format: "%.0f",
+				min: float64(st.min[id]), max: float64(st.max[id]), step: float64(max(st.step[id], 1)),
+			}},
+		})
+	}
+	return props
+}
+
+// ABS_FOCUS_POSITION, FOCUS_MOTION, REL_FOCUS_POSITION and FOCUS_MAX, the standard focuser
+// properties. outward and relative are the direction and steps of the client's relative moves.
+// The positions are Busy until the focuser is thought to have arrived, as clients wait for Ok.
+func (dev *indiDevice) focuserProperties(st *hubState, connected bool, outward bool, relative int32) []indiProperty {
+	props := dev.commonProperties(indiFocuserInterface, connected)
+	if !connected {
+		return props
+	}
+	perm := indiPerm(st.canWrite[0])
+	moving := indiOk
+	if st.moving {
+		moving = indiBusy
+	}
+	return append(props,
+		indiProperty{
+			device: dev.name, name: "ABS_FOCUS_POSITION", label: "Absolute Position", group: "Main Control",
+			kind: indiNumber, perm: perm, state: moving,
+			elements: []indiElement{{
+				name: "FOCUS_ABSOLUTE_POSITION", label: "Steps", value: indiNumberValue(int64(st.position)), format: "%.0f",
+				min: 0, max: float64(st.maxStep), step: 1,
+			}},
+		},
+		indiProperty{
+			device: dev.name, name: "FOCUS_MOTION", label: "Direction", group: "Main Control",
+			kind: indiSwitch, perm: perm, rule: "OneOfMany", state: indiOk,
+			elements: []indiElement{
+				{name: "FOCUS_INWARD", label: "Focus In", value: indiSwitchValue(!outward)},
+				{name: "FOCUS_OUTWARD", label: "Focus Out", value: indiSwitchValue(outward)},
+			},
+		},
+		indiProperty{
+			device: dev.name, name: "REL_FOCUS_POSITION", label: "Relative Position", group: "Main Control",
+			kind: indiNumber, perm: perm, state: moving,
+			elements: []indiElement{{
+				name: "FOCUS_RELATIVE_POSITION", label: "Steps", value: indiNumberValue(int64(relative)), format: "%.0f",
+				min: 0, max: float64(st.maxIncrement), step: 1,
+			}},
+		},
+		indiProperty{
+			device: dev.name, name: "FOCUS_MAX", label: "Max. Position", group: "Main Control",
+			kind: indiNumber, perm: "ro", state: indiOk,
+			elements: []indiElement{{
+				name: "FOCUS_MAX_VALUE", label: "Steps", value: indiNumberValue(int64(st.maxStep)), format: "%.0f",
+				min: 0, max: float64(st.maxStep), step: 1,
+			}},
+		},
+	)
+}
+
+// Send each watching client whatever changed since it was last sent the properties: properties
+// defined, deleted, redefined because their names or limits changed, and new values or states. The
+// property client from has just set, if any, is sent to it even if it did not change so that it
+// knows the command is done, with state Alert and the error as message if it failed.
+func (srv *indiServer) publish(from *indiClient, done *indiProperty, message string, err error) {
+	srv.Lock()
+	defer srv.Unlock()
+	states := srv.snapshots()
+	ts := indiTimestamp()
+	for c := range srv.clients {
+		if !c.watching {
+			continue
+		}
+		props := srv.properties(states, c)
+		reply := done
+		if c != from {
+			reply = nil
+		}
+		if data := indiChanges(c.last, props, reply, message, err, ts); data != "" {
+			srv.send(c, data)
+		}
+		c.last = props
+	}
+}
+
+// The elements that bring a client from the properties last to props
+func indiChanges(last []indiProperty, props []indiProperty, done *indiProperty, message string, err error, ts string) string {
+	previous := make(map[string]*indiProperty, len(last))
+	for i := range last {
+		p := &last[i]
+		previous[p.device+"."+p.name] = p
+	}
+	current := make(map[string]bool, len(props))
+	for _, p := range props {
+		current[p.device+"."+p.name] = true
+	}
+
+	var b strings.Builder
+	for _, p := range last {
+		if !current[p.device+"."+p.name] {
+			writeIndiDel(&b, p.device, p.name, ts)
+		}
+	}
+	for i := range props {
+		p := &props[i]
+		// The reply to done goes out as Alert when it failed, but props keeps the state of the
+		// hub so that the Alert stays until the property next changes
+		sent := p
+		msg := ""
+		isDone := done != nil && p.device == done.device && p.name == done.name
+		if isDone {
+			msg = message
+			if err != nil {
+				reply := *p
+				reply.state = indiAlert
+				sent = &reply
+				msg = err.Error()
+			}
+		}
+		old, ok := previous[p.device+"."+p.name]
+		switch {
+		case !ok:
+			sent.writeDef(&b, ts)
+		case !p.sameDefinition(old):
+			writeIndiDel(&b, p.device, p.name, ts)
+			sent.writeDef(&b, ts)
+		case isDone || p.state != old.state || !p.sameValues(old):
+			sent.writeSet(&b, ts, msg)
+		}
+	}
+	return b.String()
+}
+
+// Carry out a command from a client
+func (srv *indiServer) handle(c *indiClient, cmd indiCommand) {
+	switch cmd.XMLName.Local {
+	case "getProperties":
+		srv.Lock()
+		c.watching = true
+		c.last = srv.properties(srv.snapshots(), c)
+		var b strings.Builder
+		ts := indiTimestamp()
+		for _, p := range c.last {
+			if (cmd.Device == "" || cmd.Device == p.device) && (cmd.Name == "" || cmd.Name == p.name) {
+				p.writeDef(&b, ts)
+			}
+		}
+		srv.send(c, b.String())
+		srv.Unlock()
+		return
+	case "newSwitchVector", "newNumberVector", "newTextVector":
+	default:
+		// enableBLOB and anything else a client may send; no BLOBs are served
+		return
+	}
+
+	srv.Lock()
+	var dev *indiDevice
+	for _, d := range srv.devices {
+		if d.name == cmd.Device {
+			dev = d
+		}
+	}
+	var prop *indiProperty
+	for i := range c.last {
+		if c.last[i].device == cmd.Device && c.last[i].name == cmd.Name {
+			p := c.last[i]
+			prop = &p
+		}
+	}
+	if dev == nil || prop == nil {
+		var b strings.Builder
+		writeIndiMessage(&b, cmd.Device, indiTimestamp(), fmt.Sprintf("unknown property %s.%s", cmd.Device, cmd.Name))
+		srv.send(c, b.String())
+		srv.Unlock()
+		return
+	}
+	srv.Unlock()
+
+	o := changeOrigin{Source: SourceINDI, ClientID: c.id, Address: c.address}
+	message, err := srv.apply(c, dev, cmd, o)
+	srv.publish(c, prop, message, err)
+}
+
+// Make the change asked for by a new...Vector, returning a message for the client if it did
+// something other than what was asked
+func (srv *indiServer) apply(c *indiClient, dev *indiDevice, cmd indiCommand, o changeOrigin) (string, error) {
+	hub := dev.hub
+	if cmd.Name == "CONNECTION" {
+		connect, ok := cmd.choice("CONNECT", "DISCONNECT")
+		if !ok {
+			return "", errors.New("CONNECTION: CONNECT or DISCONNECT missing")
+		}
+		srv.Lock()
+		c.connected[dev.name] = connect
+		srv.Unlock()
+		return "", nil
+	}
+
+	if !dev.focuser {
+		if n, found := strings.CutPrefix(cmd.Name, "POWER_PORT_"); found {
+			id, err := strconv.Atoi(n)
+			if err != nil {
+				return "", err
+			}
+			on, ok := cmd.choice("ON", "OFF")
+			if !ok {
+				return "", fmt.Errorf("%s: ON or OFF missing", cmd.Name)
+			}
+			return "", srv.setOnOff(hub, int32(id), on, o)
+		}
+		if n, found := strings.CutPrefix(cmd.Name, "DEW_HEATER_"); found {
+			heater, err := strconv.Atoi(n)
+			if err != nil {
+				return "", err
+			}
+			level, err := cmd.number("LEVEL")
+			if err != nil {
+				return "", err
+			}
+			return "", srv.setValue(hub, NumOnOffSwitch+int32(heater), int64(math.Round(level)), o)
+		}
+		return "", fmt.Errorf("%s cannot be set", cmd.Name)
+	}
+
+	position := MhpGetPosition(hub)
+	switch cmd.Name {
+	case "ABS_FOCUS_POSITION":
+		target, err := cmd.number("FOCUS_ABSOLUTE_POSITION")
+		if err != nil {
+			return "", err
+		}
+		if int32(math.Round(target)) == position {
+			return "", nil
+		}
+		return "", srv.move(hub, int32(math.Round(target)), o)
+	case "FOCUS_MOTION":
+		outward, ok := cmd.choice("FOCUS_OUTWARD", "FOCUS_INWARD")
+		if !ok {
+			return "", errors.New("FOCUS_MOTION: FOCUS_INWARD or FOCUS_OUTWARD missing")
+		}
+		srv.Lock()
+		c.outward[dev.name] = outward
+		srv.Unlock()
+		return "", nil
+	case "REL_FOCUS_POSITION":
+		steps, err := cmd.number("FOCUS_RELATIVE_POSITION")
+		if err != nil {
+			return "", err
+		}
+		srv.Lock()
+		c.relative[dev.name] = int32(math.Round(steps))
+		delta := c.relative[dev.name]
+		if !c.outward[dev.name] {
+			delta = -delta
+		}
+		srv.Unlock()
+		if delta == 0 {
+			return "", nil
+		}
+		// Stop at the ends rather than refusing the move, as other INDI focusers do
+		target := min(max(position+delta, 0), MhpGetMaxStep(hub))
+		if target == position {
+			return "", errors.New("the focuser is already at the end of its travel")
+		}
+		if err := srv.move(hub, target, o); err != nil {
+			return "", err
+		}
+		if target != position+delta {
+			return fmt.Sprintf("stopped at %d, the end of travel", target), nil
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("%s cannot be set", cmd.Name)
+}
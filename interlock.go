@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Write protection and interlocks. A channel with canwrite false in settings.json cannot be
+// changed through MhpSetOnOff, MhpSetValue or MhpMove, and interlocks refuse a change while
+// another channel is on or off, for example:
+//
+//	{ "id": 2, "block": "off", "while": 5, "is": "on" }   port 2 cannot be turned off while port 5 is on
+//	{ "id": 0, "block": "move", "while": 1, "is": "off" } the focuser cannot move while port 1 is off
+//
+// Automatic dew control is checked like a client. The startup outputs, the shutdown policy and
+// channels brought back within their limits after a reload or a profile switch are applied by the
+// driver itself and are not checked.
+
+// Interlock actions
+const (
+	BlockOn   = "on"   // turning a port on, or a dew heater up from 0
+	BlockOff  = "off"  // turning a port off, or a dew heater down to 0
+	BlockMove = "move" // moving the focuser
+)
+
+type interlock struct {
+	Id    int32  `json:"id"`    // channel that is blocked, 1 to 12, or 0 for the focuser
+	Block string `json:"block"` // on, off or move
+	While int32  `json:"while"` // channel that must not be in the is state, 1 to 12
+	Is    string `json:"is"`    // on or off
+}
+
+// A change refused by canwrite or an interlock rather than one that failed.
+// Alpaca reports these as InvalidOperation.
+type refusedError struct {
+	reason string
+}
+
+func (e *refusedError) Error() string {
+	return e.reason
+}
+
+func refused(format string, a ...any) error {
+	return &refusedError{fmt.Sprintf(format, a...)}
+}
+
+func isRefused(err error) bool {
+	var r *refusedError
+	return errors.As(err, &r)
+}
+
+// Report whether channel id, 0 for the focuser, can be changed by clients
+func MhpGetCanWrite(hub int, id int32) (bool, error) {
+	if id < 0 || id > NumSwitches {
+		return false, errors.New("invalid switch number")
+	}
+	h := hubs[hub]
+	sm.Lock()
+	defer sm.Unlock()
+	return h.Canwrite[id], nil
+}
+
+// Check that channel id may be set to value, or that the focuser may move if id is 0.
+// Caller must not hold sm.
+func (s *sw) checkChange(id int32, value int64) error {
+	sm.Lock()
+	defer sm.Unlock()
+	if !s.Canwrite[id] {
+		return refused("%s is read only", s.channelName(id))
+	}
+
+	action := BlockMove
+	if id != 0 {
+		on, wasOn := value != 0, s.Value[id] != 0
+		if on == wasOn {
+			// Not turned on or off, e.g. a dew heater going from 30 to 50
+			return nil
+		}
+		action = BlockOff
+		if on {
+			action = BlockOn
+		}
+	}
+	for _, l := range s.Interlocks {
+		if l.Id != id || l.Block != action {
+			continue
+		}
+		if (s.Value[l.While] != 0) != (l.Is == BlockOn) {
+			continue
+		}
+		if id == 0 {
+			return refused("%s cannot move while %s is %s", s.channelName(id), s.channelName(l.While), l.Is)
+		}
+		return refused("%s cannot be turned %s while %s is %s", s.channelName(id), action, s.channelName(l.While), l.Is)
+	}
+	return nil
+}
+
+// Caller must hold sm
+func (s *sw) channelName(id int32) string {
+	if s.Customname[id] != "" {
+		return s.Customname[id]
+	}
+	return s.Name[id]
+}
+
+func (c *swconfig) validateInterlocks(add func(field string, format string, a ...any)) {
+	for i, l := range c.Interlocks {
+		field := func(name string) string {
+			return fmt.Sprintf("interlocks[%d].%s", i, name)
+		}
+		switch {
+		case l.Id < 0 || l.Id > NumSwitches:
+			add(field("id"), "must be 0 for the focuser or a switch number from 1 to %d, found %d", NumSwitches, l.Id)
+		case l.Id == 0 && l.Block != BlockMove:
+			add(field("block"), "must be %s for the focuser, found %q", BlockMove, l.Block)
+		case l.Id != 0 && l.Block != BlockOn && l.Block != BlockOff:
+			add(field("block"), "must be %s or %s for a switch, found %q", BlockOn, BlockOff, l.Block)
+		}
+		if l.While < 1 || l.While > NumSwitches || l.While == l.Id {
+			add(field("while"), "must be another switch number from 1 to %d, found %d", NumSwitches, l.While)
+		}
+		if l.Is != BlockOn && l.Is != BlockOff {
+			add(field("is"), "must be %s or %s, found %q", BlockOn, BlockOff, l.Is)
+		}
+	}
+}
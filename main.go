@@ -1,6 +1,14 @@
 package main
 
-import "time"
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
 
 const apiPort = 8080
 const DiscoveryPort = 32227
@@ -9,14 +17,67 @@ const ListenIP = "127.0.0.1"
 const Location = "Earth"
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Load initial switch values
-	MhpSetInit()
+	if err := MhpSetInit(); err != nil {
+		log.Fatalf("Invalid settings, not starting:\n%v", err)
+	}
+	MhpStartStateWriter()
+	// Everything that can change the outputs in the background, stopped by ctx and waited for
+	// before the shutdown policy is applied
+	var background sync.WaitGroup
+	run := func(f func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			f()
+		}()
+	}
+	run(func() { MhpWatchSettings(ctx) })
+	run(func() { MhpExpireClients(ctx) })
+	if err := MhpLoadSchedules(); err != nil {
+		log.Println("Schedules not loaded:", err)
+	}
+	run(func() { MhpRunScheduler(ctx) })
+	for hub := 0; hub < MhpHubCount(); hub++ {
+		// Clients connect again after a restart, see clients.go
+		MhpSetConnect(hub, false)
+		run(func() { MhpRunDewControl(ctx, hub) })
+		run(func() { MhpRunDewSchedule(ctx, hub) })
+		run(func() {
+			MhpRestore(ctx, hub)
+			MhpScheduleHub(hub)
+			if ctx.Err() == nil && MhpGetBootOnStart(hub) {
+				if err := MhpStartBootSequence(ctx, hub); err != nil {
+					log.Println("Boot sequence of hub", hub, "not started:", err)
+				}
+			}
+		})
+	}
 	discovery := NewDiscoverySever(DiscoveryPort, apiPort)
 	api := NewApiServer(apiPort)
+	api.Discovery = discovery
 	go discovery.Start()
-	defer discovery.Close()
 	go api.Start()
-	for {
-		time.Sleep(10 * time.Second)
+	mqttDone := MhpStartMQTT(ctx)
+	indiDone := MhpStartINDI(ctx)
+
+	<-ctx.Done()
+	log.Println("Shutting down")
+	discovery.Close()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := api.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error waiting for requests to finish:", err)
 	}
+	<-mqttDone
+	<-indiDone
+	background.Wait()
+	MhpShutdown()
 }
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -12,9 +14,16 @@ import (
 // Management API router
 func (srv *ApiServer) configureManagementAPI(router *httprouter.Router) {
 	router.GET("/", srv.handleRoot)
-	router.GET("/management/apiversions", srv.handleApiVersions)
-	router.GET("/management/v1/description", srv.handleDescription)
-	router.GET("/management/v1/configureddevices", srv.handleConfiguredDevices)
+	router.GET("/management/apiversions", srv.alpaca(srv.handleApiVersions))
+	router.GET("/management/v1/description", srv.alpaca(srv.handleDescription))
+	router.GET("/management/v1/configureddevices", srv.alpaca(srv.handleConfiguredDevices))
+	router.GET("/management/v1/connectedclients", srv.alpaca(srv.handleConnectedClients))
+	router.PUT("/management/v1/reload", srv.alpaca(srv.handleReload))
+	router.GET("/management/v1/audit", srv.handleAudit)
+	router.GET("/metrics", srv.handleMetrics)
+	router.GET("/healthz", srv.handleHealthz)
+	router.GET("/readyz", srv.handleReadyz)
+	router.POST("/setup/v1/profile", srv.handleUseProfile)
 }
 
 // Returns root web page.
@@ -62,3 +71,79 @@ func (srv *ApiServer) handleConfiguredDevices(w http.ResponseWriter, r *http.Req
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
+
+// Lists the clients connected to each device with the time of their last transaction. Not part of the Alpaca standard.
+func (srv *ApiServer) handleConnectedClients(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	resp := connectedClientsResponse{
+		Value: connectedClients(),
+	}
+	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Reloads settings.json without restarting the driver. Not part of the Alpaca standard.
+func (srv *ApiServer) handleReload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	err := MhpReloadSettings()
+	if err != nil {
+		resp := stringResponse{
+			Value: err.Error(),
+		}
+		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	resp := putResponse{}
+	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Returns the audit log, see audit.go. Not part of the Alpaca standard.
+// Optional parameters: From and To (RFC 3339 time or date), Hub, and Format (json, the default, or csv).
+func (srv *ApiServer) handleAudit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	filter := auditFilter{Hub: -1}
+	var err error
+	if filter.From, err = parseAuditTime("from", alpacaParam(r, "From")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.To, err = parseAuditTime("to", alpacaParam(r, "To")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if hub := alpacaParam(r, "Hub"); hub != "" {
+		if filter.Hub, err = strconv.Atoi(hub); err != nil || checkHub(filter.Hub) != nil {
+			http.Error(w, fmt.Sprintf("invalid hub %q", hub), http.StatusBadRequest)
+			return
+		}
+	}
+	format := strings.ToLower(alpacaParam(r, "Format"))
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, fmt.Sprintf("format must be json or csv, found %q", format), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := readAudit(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		w.WriteHeader(http.StatusOK)
+		writeAuditCSV(w, entries)
+		return
+	}
+	if entries == nil {
+		entries = []auditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Prometheus metrics at /metrics in the text exposition format. The outputs of the hubs are
+// read when the metrics are scraped; HID sends, Alpaca requests and discovery packets are
+// counted as they happen.
+
+// Upper bounds of the HID send latency histogram, in seconds
+var hidLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// A counter for each combination of label values
+type counterVec struct {
+	sync.Mutex
+	values map[string]float64 // keyed by the rendered labels, e.g. {hub="0"}
+}
+
+func (c *counterVec) inc(labels string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[labels]++
+}
+
+func (c *counterVec) write(w io.Writer, name string, help string) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, labels := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", name, labels, c.values[labels])
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// A histogram for each combination of label values
+type histogramVec struct {
+	sync.Mutex
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func (h *histogramVec) observe(labels string, v float64) {
+	h.Lock()
+	defer h.Unlock()
+	if h.values == nil {
+		h.values = make(map[string]*histogram)
+	}
+	hist := h.values[labels]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[labels] = hist
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer, name string, help string) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, labels := range sortedKeys(h.values) {
+		hist := h.values[labels]
+		// Bucket labels go after the others: {hub="0",le="0.01"}
+		prefix := "{"
+		if labels != "" {
+			prefix = strings.TrimSuffix(labels, "}") + ","
+		}
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%sle=\"%g\"} %d\n", name, prefix, le, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", name, prefix, hist.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels, hist.count)
+	}
+}
+
+var metrics struct {
+	hidSends         counterVec
+	hidErrors        counterVec
+	hidLatency       histogramVec
+	focuserMoves     counterVec
+	alpacaRequests   counterVec
+	discoveryPackets counterVec
+}
+
+func init() {
+	metrics.hidLatency.buckets = hidLatencyBuckets
+}
+
+// Render label pairs, e.g. labels("hub", "0", "switch", "1") is {hub="0",switch="1"}
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Record a command sent to hub and how long it took
+func metricsHidSend(hub int, elapsed time.Duration, err error) {
+	l := labels("hub", strconv.Itoa(hub))
+	metrics.hidSends.inc(l)
+	metrics.hidLatency.observe(l, elapsed.Seconds())
+	if err != nil {
+		metrics.hidErrors.inc(l)
+	}
+}
+
+type alpacaOutcomeKey struct{}
+
+// What the handler of an Alpaca request answered, filled in by metricsAlpacaRequest
+type alpacaOutcome struct {
+	answered    bool // an Alpaca response was prepared
+	errorNumber int32
+}
+
+// Records the HTTP status written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Count the Alpaca requests served by next by method, endpoint, HTTP status and the error number
+// of the response. Requests rejected with a 400 before reaching a handler, such as those for an
+// unknown device or with a malformed ClientID, are counted with error number 0 like the 400s of
+// the handlers; their status tells them apart from successful requests. Other requests that get
+// no Alpaca response, such as those for unknown paths, are not counted.
+func metricsAlpacaRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outcome := &alpacaOutcome{}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), alpacaOutcomeKey{}, outcome)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if !outcome.answered && (rec.status != http.StatusBadRequest || !strings.HasPrefix(r.URL.Path, "/api/")) {
+			return
+		}
+		metrics.alpacaRequests.inc(labels("method", r.Method, "endpoint", metricsEndpoint(r.URL.Path),
+			"status", strconv.Itoa(rec.status), "error_number", strconv.Itoa(int(outcome.errorNumber))))
+	})
+}
+
+// Record the error number of the response to an Alpaca request, counted by metricsAlpacaRequests
+func metricsAlpacaRequest(r *http.Request, errorNumber int32) {
+	if outcome, ok := r.Context().Value(alpacaOutcomeKey{}).(*alpacaOutcome); ok {
+		outcome.answered = true
+		outcome.errorNumber = errorNumber
+	}
+}
+
+// The route of a request path, with the device number left out so that
+// every hub shares a series: /api/v1/switch/:device_number/getswitch
+func metricsEndpoint(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) > 4 && parts[1] == "api" {
+		// Invalid device numbers too, so that they cannot add series without end
+		parts[4] = ":device_number"
+	}
+	return strings.Join(parts, "/")
+}
+
+func metricsFocuserMove(hub int) {
+	metrics.focuserMoves.inc(labels("hub", strconv.Itoa(hub)))
+}
+
+func metricsDiscoveryPacket(replied bool) {
+	metrics.discoveryPackets.inc(labels("replied", strconv.FormatBool(replied)))
+}
+
+// Serves the metrics to Prometheus. Not part of the Alpaca standard.
+func (srv *ApiServer) handleMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	writeHubMetrics(w)
+	metrics.focuserMoves.write(w, "mhp_focuser_moves_total", "Focuser moves sent to the hub.")
+	metrics.hidSends.write(w, "mhp_hid_sends_total", "Commands sent to the hub over USB HID.")
+	metrics.hidErrors.write(w, "mhp_hid_send_errors_total", "Commands that could not be sent to the hub.")
+	metrics.hidLatency.write(w, "mhp_hid_send_duration_seconds", "Time taken to send a command to the hub, including opening it.")
+	metrics.alpacaRequests.write(w, "mhp_alpaca_requests_total", "Alpaca requests by method, endpoint, HTTP status and error number.")
+	metrics.discoveryPackets.write(w, "mhp_discovery_packets_total", "Alpaca discovery packets received, by whether they were answered.")
+}
+
+// The current outputs of every hub
+func writeHubMetrics(w io.Writer) {
+	type output struct {
+		labels string
+		value  float64
+	}
+	var switches, heaters, positions, connected []output
+	sm.Lock()
+	for hub, h := range hubs {
+		n := strconv.Itoa(hub)
+		for id := int32(1); id <= NumSwitches; id++ {
+			name := h.channelName(id)
+			if id <= NumOnOffSwitch {
+				switches = append(switches, output{labels("hub", n, "switch", strconv.Itoa(int(id)), "name", name), float64(h.Value[id])})
+			} else {
+				heaters = append(heaters, output{labels("hub", n, "heater", strconv.Itoa(int(id-NumOnOffSwitch)), "name", name), float64(h.Value[id])})
+			}
+		}
+		positions = append(positions, output{labels("hub", n), float64(h.Focucerposition)})
+		c := 0.0
+		if h.Connected {
+			c = 1
+		}
+		connected = append(connected, output{labels("hub", n), c})
+	}
+	sm.Unlock()
+
+	gauge := func(name string, help string, outputs []output) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, o := range outputs {
+			fmt.Fprintf(w, "%s%s %g\n", name, o.labels, o.value)
+		}
+	}
+	gauge("mhp_switch_state", "Power port state, 1 for on.", switches)
+	gauge("mhp_dew_heater_level", "Dew heater power in percent.", heaters)
+	gauge("mhp_focuser_position", "Focuser position in steps.", positions)
+	gauge("mhp_hub_connected", "1 if an Alpaca client is connected to the hub.", connected)
+}
@@ -1,195 +1,286 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
 	"log"
-	"os"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/karalabe/usb"
 )
 
 const NumOnOffSwitch = 8 // Number of on/off switches
 const NumVarSwitch = 4   // Number of variable switches
 const NumSwitches = 12   // Number of all switches in total
 
-// type swm sync.RWMutex
+// The hub does not report when a focuser move has finished. Its end is estimated taking the
+// speed byte sent with the move as the time per step in units of focuserStepTime, plus
+// focuserSettleTime, which errs on the long side.
+const focuserStepTime = 20 * time.Microsecond
+const focuserSettleTime = 250 * time.Millisecond
+
+// What to do with the hub outputs when the driver shuts down
+const (
+	ShutdownLeave  = "leave"  // leave all outputs as they are
+	ShutdownDewOff = "dewoff" // turn the dew heaters off
+	ShutdownAllOff = "alloff" // turn the dew heaters and all power ports off
+)
+
+// What to send to the hub when the driver starts, the hub forgets its outputs when it loses power
+const (
+	StartupRestore = "restore" // restore the outputs saved in state.json
+	StartupAllOff  = "alloff"  // turn the dew heaters and all power ports off
+	StartupDefault = "default" // set each output to its value in default
+	StartupNone    = "none"    // send nothing
+)
+
+// Alpaca device types served for each hub
+const (
+	DeviceTypeSwitch  = "Switch"
+	DeviceTypeFocuser = "Focuser"
+)
+
+// One Mount Hub Pro
 type sw struct {
-	Connected           bool       `json:"connected"`
-	Focusermaxincrement int32      `json:"focucermaxincrement"`
-	Focusermaxstep      int32      `json:"focucermaxstep"`
-	Focucerposition     int32      `json:"focucerposition"`
-	Focucerspeed        int32      `json:"focucerspeed"`
-	Name                [13]string `json:"name"`       // *
-	Devicetype          [13]string `json:"devicetype"` // *
-	Number              [13]uint32 `json:"number"`     // *
-	Uniqueid            [13]string `json:"uniqueid"`   // *
-	Id                  [13]uint32 `json:"id"`
-	Customname          [13]string `json:"customname"`
-	Min                 [13]int64  `json:"min"`
-	Max                 [13]int64  `json:"max"`
-	Step                [13]int64  `json:"step"`
-	Canwrite            [13]bool   `json:"canwrite"`
-	Value               [13]int64  `json:"value"`
-}
-
-var s = &sw{}
+	swconfig
+	swstate
+	swlegacy
+	hid        usb.Device         // open HID device, see hid.go
+	bootCancel context.CancelFunc // stops a running boot sequence, see boot.go
+	changes    sync.Mutex         // held while a change is checked and sent, see interlock.go
+	moveEnds   time.Time          // estimated end of the last focuser move, see mhpmove
+}
+
+// Configuration of the hub, saved in settings.json when it is changed
+type swconfig struct {
+	Version             int                     `json:"version"`
+	Profile             string                  `json:"profile"`   // name of the profile last used or saved
+	Usbpath             string                  `json:"usbpath"`   // identifies the hub when more than one is connected
+	Usbserial           string                  `json:"usbserial"` // alternative to usbpath if the hub reports a serial number
+	Focusermaxincrement int32                   `json:"focucermaxincrement"`
+	Focusermaxstep      int32                   `json:"focucermaxstep"`
+	Focucerspeed        int32                   `json:"focucerspeed"`
+	Shutdownpolicy      string                  `json:"shutdownpolicy"`
+	Startupmode         string                  `json:"startupmode"`
+	Switchuniqueid      string                  `json:"switchuniqueid"`
+	Focuseruniqueid     string                  `json:"focuseruniqueid"`
+	Name                [13]string              `json:"name"` // *
+	Id                  [13]uint32              `json:"id"`
+	Customname          [13]string              `json:"customname"`
+	Min                 [13]int64               `json:"min"`
+	Max                 [13]int64               `json:"max"`
+	Step                [13]int64               `json:"step"`
+	Canwrite            [13]bool                `json:"canwrite"`
+	Critical            [13]bool                `json:"critical"`      // turning off needs confirmation, see critical.go
+	Confirmwindow       int32                   `json:"confirmwindow"` // seconds to confirm turning off a critical channel
+	Default             [13]int64               `json:"default"`
+	Bootonstart         bool                    `json:"bootonstart"`
+	Bootsequence        []bootStep              `json:"bootsequence"`
+	Dewheaters          [NumVarSwitch]dewHeater `json:"dewheaters"`
+	Weather             weatherSource           `json:"weather"`
+	Dewschedule         dewSchedule             `json:"dewschedule"`
+	Interlocks          []interlock             `json:"interlocks"`
+}
+
+// Runtime state of the hub, saved in state.json in the background by the state writer
+type swstate struct {
+	Connected       bool      `json:"connected"`
+	Focucerposition int32     `json:"focucerposition"`
+	Value           [13]int64 `json:"value"`
+}
+
+// Fields of settings files from before version 5, when every channel was listed as a device.
+// They are read so that they can be migrated and never written again.
+type swlegacy struct {
+	Devicetype *[13]string `json:"devicetype,omitempty"`
+	Number     *[13]uint32 `json:"number,omitempty"`
+	Uniqueid   *[13]string `json:"uniqueid,omitempty"`
+}
+
+// The hubs in the order they appear in settings.json. Hub n is served as Alpaca switch n and focuser n.
+// The number of hubs is fixed once the settings have been loaded.
+var hubs []*sw
 var sm sync.RWMutex
 
-func MhpSetInit() {
-	s.mhpsetinit()
-}
-
-func (s *sw) mhpsetinit() {
-	if !s.mhpLoadSettings() {
+func MhpSetInit() error {
+	loaded, err := mhpLoadSettings()
+	if err != nil {
+		return err
+	}
+	if !loaded {
 		sm.Lock()
-		// set up the defaults
-		s.Connected = false
-		s.Focusermaxincrement = 150
-		s.Focusermaxstep = 65535
-		s.Focucerposition = 1000
-		s.Focucerspeed = 50 // Range is 0 to 100%
-		s.Name = [13]string{"Focuser", "Switch 1", "Switch 2", "Switch 3", "Switch 4", "Switch 5", "Switch 6", "Switch 7", "Switch 8", "Dew Heater 1", "Dew Heater 2", "Dew Heater 3", "Dew Heater 4"}
-		s.Devicetype = [13]string{"Focuser", "Switch", "Switch", "Switch", "Switch", "Switch", "Switch", "Switch", "Switch", "Switch", "Switch", "Switch", "Switch"}
-		s.Number = [13]uint32{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
-		s.Id = [13]uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
-		s.Customname = [13]string{"", "", "", "", "", "", "", "", "", "", "", "", ""}
-		s.Min = [13]int64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
-		s.Max = [13]int64{65535, 1, 1, 1, 1, 1, 1, 1, 1, 100, 100, 100, 100}
-		s.Step = [13]int64{150, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
-		s.Canwrite = [13]bool{true, true, true, true, true, true, true, true, true, true, true, true, true}
-		s.Value = [13]int64{1000, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
-		s.Uniqueid = [13]string{"6fd5bae2-40ed-489f-b6f3-a562822e48e9", "86c4b6ea-650d-45cd-ad5d-1771c86edee6", "b96a0f0d-3b3f-4240-a7dc-807645a91a9a", "5cf95480-14ed-49c6-b992-a5eb8c4c9fb2", "9e2090fa-a793-4d4e-9302-3d97ba5566d2", "16eef02f-e1f0-4b94-8a66-a45ca005246f", "8d5641ce-34d4-4750-a0d7-210603a4ea33", "177ed90e-f8f4-46c3-8bd3-b00e4c7dedb5", "c0babc9b-4403-4b8f-9d5a-f53a848f7aa2", "96730903-e921-4a0d-8f45-f76597cf6259", "0c466cbc-a363-40fb-825c-07e33f0c696f", "41ce27ac-de5c-472a-a2a2-c37e3490c627", "5e95431e-6a38-4cd3-8cc0-65dfdb087e82"}
+		h := &sw{}
+		h.mhpsetdefaults()
+		hubs = []*sw{h}
 		sm.Unlock()
-		s.mhpSaveSettings()
+		if err := mhpSaveState(); err != nil {
+			return err
+		}
+		return mhpSaveSettings()
 	}
+	return nil
 }
 
-func (s *sw) mhpSaveSettings() {
-	sm.Lock()
-	defer sm.Unlock()
+// Number of hubs configured in settings.json
+func MhpHubCount() int {
+	return len(hubs)
+}
 
-	data, err := json.MarshalIndent(&s, "", "    ")
-	if err != nil {
-		panic(err)
-	}
-	err = os.WriteFile("settings.json", data, 0644) //os.ModeExclusive)
-	if err != nil {
-		panic(err)
+// Position of the hub in settings.json
+func (s *sw) number() int {
+	for hub, h := range hubs {
+		if h == s {
+			return hub
+		}
 	}
+	return -1
 }
 
-func (s *sw) mhpLoadSettings() (result bool) {
-	sm.Lock()
-	defer sm.Unlock()
-	data, err := os.ReadFile("settings.json")
-	if err != nil {
-		return false
+func checkHub(hub int) error {
+	if hub < 0 || hub >= len(hubs) {
+		return fmt.Errorf("invalid hub number %d, %d hub(s) configured", hub, len(hubs))
 	}
-
-	err = json.Unmarshal(data, &s)
-	return err == nil
+	return nil
+}
+
+func (s *sw) mhpsetdefaults() {
+	s.Version = settingsVersion
+	s.Connected = false
+	s.Focusermaxincrement = 150
+	s.Focusermaxstep = 65535
+	s.Focucerposition = 1000
+	s.Focucerspeed = 50 // Range is 0 to 100%
+	s.Shutdownpolicy = ShutdownLeave
+	s.Startupmode = StartupRestore
+	s.Name = [13]string{"Focuser", "Switch 1", "Switch 2", "Switch 3", "Switch 4", "Switch 5", "Switch 6", "Switch 7", "Switch 8", "Dew Heater 1", "Dew Heater 2", "Dew Heater 3", "Dew Heater 4"}
+	s.Id = [13]uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	s.Customname = [13]string{"", "", "", "", "", "", "", "", "", "", "", "", ""}
+	s.Min = [13]int64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	s.Max = [13]int64{65535, 1, 1, 1, 1, 1, 1, 1, 1, 100, 100, 100, 100}
+	s.Step = [13]int64{150, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+	s.Canwrite = [13]bool{true, true, true, true, true, true, true, true, true, true, true, true, true}
+	s.Critical = [13]bool{}
+	s.Confirmwindow = defaultConfirmWindow
+	s.Value = [13]int64{1000, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	s.Default = [13]int64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	s.Bootonstart = false
+	s.Bootsequence = []bootStep{}
+	s.Interlocks = []interlock{}
+	for n := range s.Dewheaters {
+		s.Dewheaters[n] = defaultDewHeater()
+	}
+	s.Weather = defaultWeatherSource()
+	s.Dewschedule = defaultDewSchedule()
+	s.Switchuniqueid = newUniqueID()
+	s.Focuseruniqueid = newUniqueID()
 }
 
-func MhpGetInit() []DeviceConfiguration {
-	return s.mhpgetinit()
+// An Alpaca device served by the driver and the hub behind it
+type hubDevice struct {
+	DeviceConfiguration
+	hub int
 }
 
-func (s *sw) mhpgetinit() []DeviceConfiguration {
+// The device table: a switch and a focuser for each hub, both numbered by the position of the hub
+func mhpDevices() []hubDevice {
 	sm.Lock()
 	defer sm.Unlock()
+	var devices []hubDevice
+	for hub, h := range hubs {
+		devices = append(devices,
+			hubDevice{DeviceConfiguration{
+				DeviceName:   "Mount Hub Pro",
+				DeviceType:   DeviceTypeSwitch,
+				DeviceNumber: uint32(hub),
+				UniqueID:     h.Switchuniqueid,
+			}, hub},
+			hubDevice{DeviceConfiguration{
+				DeviceName:   h.Name[0],
+				DeviceType:   DeviceTypeFocuser,
+				DeviceNumber: uint32(hub),
+				UniqueID:     h.Focuseruniqueid,
+			}, hub},
+		)
+	}
+	return devices
+}
+
+func MhpGetInit() []DeviceConfiguration {
 	var val []DeviceConfiguration
-	for i := range s.Name {
-		val = append(val, DeviceConfiguration{
-			DeviceName:   s.Name[i],
-			DeviceType:   s.Devicetype[i],
-			DeviceNumber: s.Number[i], //s.Id[i],
-			UniqueID:     s.Uniqueid[i],
-		})
+	for _, d := range mhpDevices() {
+		val = append(val, d.DeviceConfiguration)
 	}
 	return val
 }
 
-func MhpSetName(id int32, CustomName string) (err error) {
-	if id < 0 || id >= NumSwitches {
+// Find the hub serving a device, deviceType is matched without regard to case as in Alpaca URLs
+func MhpFindDevice(deviceType string, number uint32) (hub int, ok bool) {
+	for _, d := range mhpDevices() {
+		if strings.EqualFold(d.DeviceType, deviceType) && d.DeviceNumber == number {
+			return d.hub, true
+		}
+	}
+	return -1, false
+}
+
+func MhpSetName(hub int, id int32, CustomName string) (err error) {
+	if err = checkHub(hub); err != nil {
+		return
+	}
+	if id < 1 || id > NumSwitches {
 		err = errors.New("invalid device number")
+		return
 	}
-	s.setname(id, CustomName)
-	return
+	return hubs[hub].setname(id, CustomName)
 }
 
-func (s *sw) setname(id int32, CustomName string) {
+func (s *sw) setname(id int32, CustomName string) error {
 	sm.Lock()
 	s.Customname[id] = CustomName
 	sm.Unlock()
-	s.mhpSaveSettings()
+	return mhpSaveSettings()
 }
 
-func MhpSetConnect(c bool) {
-	s.setconnect(c)
+func MhpSetConnect(hub int, c bool) {
+	hubs[hub].setconnect(c)
 }
 
 func (s *sw) setconnect(c bool) {
 	sm.Lock()
 	s.Connected = c
 	sm.Unlock()
-	s.mhpSaveSettings()
+	stateChanged()
+	if !c {
+		// No client needs the hub, let other programs use it
+		s.hidClose()
+	}
 }
 
-func MhpGetConnected() bool {
-	return s.getconnected()
+func MhpGetConnected(hub int) bool {
+	return hubs[hub].getconnected()
 }
 
 func (s *sw) getconnected() bool {
 	sm.Lock()
 	defer sm.Unlock()
-	return s.Connected // needs to be fixed
+	return s.Connected
 }
 
-func MhpGetName(id int32) string {
-	return s.getname(id)
+func MhpGetName(hub int, id int32) string {
+	return hubs[hub].getname(id)
 }
 
 func (s *sw) getname(id int32) string {
 	sm.Lock()
 	defer sm.Unlock()
-	if s.Customname[id] != "" {
-		return s.Customname[id]
-	}
-	return s.Name[id]
-}
-
-func MhpGetType(id int32) string {
-	return s.gettype(id)
-}
-
-func (s *sw) gettype(id int32) string {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Devicetype[id]
-}
-
-func MhpGetNumber(id uint32) uint32 {
-	return s.getnumber(id)
-}
-
-func (s *sw) getnumber(id uint32) uint32 {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Number[id]
-}
-
-func MhpGetUniqueID(id int32) string {
-	return s.getuniqueid(id)
+	return s.channelName(id)
 }
 
-func (s *sw) getuniqueid(id int32) string {
-	sm.Lock()
-	defer sm.Unlock()
-	return s.Uniqueid[id]
-}
-
-func MhpGetOnOff(id int32) (result bool, err error) {
-	return s.getonoff(id)
+func MhpGetOnOff(hub int, id int32) (result bool, err error) {
+	return hubs[hub].getonoff(id)
 }
 
 func (s *sw) getonoff(id int32) (result bool, err error) {
@@ -208,8 +299,8 @@ func (s *sw) getonoff(id int32) (result bool, err error) {
 	return
 }
 
-func MhpGetValue(id int32) int64 {
-	return s.getvalue(id)
+func MhpGetValue(hub int, id int32) int64 {
+	return hubs[hub].getvalue(id)
 }
 
 func (s *sw) getvalue(id int32) int64 {
@@ -218,8 +309,8 @@ func (s *sw) getvalue(id int32) int64 {
 	return s.Value[id]
 }
 
-func MhpGetMax(id int32) int64 {
-	return s.getmax(id)
+func MhpGetMax(hub int, id int32) int64 {
+	return hubs[hub].getmax(id)
 }
 
 func (s *sw) getmax(id int32) int64 {
@@ -228,8 +319,8 @@ func (s *sw) getmax(id int32) int64 {
 	return s.Max[id]
 }
 
-func MhpGetMin(id int32) int64 {
-	return s.getmin(id)
+func MhpGetMin(hub int, id int32) int64 {
+	return hubs[hub].getmin(id)
 }
 
 func (s *sw) getmin(id int32) int64 {
@@ -238,8 +329,8 @@ func (s *sw) getmin(id int32) int64 {
 	return s.Min[id]
 }
 
-func MhpGetStep(id int32) int64 {
-	return s.getstep(id)
+func MhpGetStep(hub int, id int32) int64 {
+	return hubs[hub].getstep(id)
 }
 
 func (s *sw) getstep(id int32) int64 {
@@ -248,29 +339,53 @@ func (s *sw) getstep(id int32) int64 {
 	return s.Step[id]
 }
 
+// Make a change to channel id, 0 for the focuser, with apply once it has passed canwrite, the
+// interlocks and, for a critical channel being turned off, confirmation
+func (s *sw) change(id int32, value int64, o changeOrigin, apply func() error) error {
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	if err := s.checkChange(id, value); err != nil {
+		return err
+	}
+	if err := s.confirmChange(id, value, o); err != nil {
+		return err
+	}
+	return apply()
+}
+
 // Function sends the command to set the 4 variable switches (i.e. dew heater controllers).
 // id is from 8 to 11. range / value is from 0 to 100 (0x00 to 0x64)
-func MhpSetValue(id int32, value int64) (err error) {
+func MhpSetValue(hub int, id int32, value int64, o changeOrigin) (err error) {
+	if err = checkHub(hub); err != nil {
+		return
+	}
 	if id < 1 || id > NumSwitches {
 		err = errors.New("invalid switch number")
 		return
 	}
 
-	if value < 0 || value > s.Max[id] { //100
+	if value < 0 || value > MhpGetMax(hub, id) { //100
 		err = errors.New("invalid switch level")
 		return
 	}
 
 	// Check for special case of on/off switches
 	if id >= 1 && id <= NumOnOffSwitch {
-		err = MhpSetOnOff(id, value == 1)
+		err = MhpSetOnOff(hub, id, value == 1, o)
 		return
 	}
 	// Case for dew heaters
-	return s.setvalue(id, value)
+	h := hubs[hub]
+	if h.dewAutomatic(id - NumOnOffSwitch) {
+		err = refused("dew heater %d is under automatic control", id-NumOnOffSwitch)
+		return
+	}
+	return h.change(id, value, o, func() error {
+		return h.setvalue(id, value, o)
+	})
 }
 
-func (s *sw) setvalue(id int32, value int64) (err error) {
+func (s *sw) setvalue(id int32, value int64, o changeOrigin) (err error) {
 	// Examples				Hex     Decimal
 	// Switch 9 to 0 		4b 00	75 00
 	// Switch 9 to 50 		4b 32	75 50
@@ -284,7 +399,7 @@ func (s *sw) setvalue(id int32, value int64) (err error) {
 	// Value is in the 2 most significant digits Switch number is the 2 lest significant 2 hex digits.
 	var command int32 = (int32(value) * 0x100) + (0x48 + 12 - int32(id))
 	log.Println("Set dew heater no ", id-8, " to ", value)
-	err = hidSend(int64(command))
+	err = s.hidSend(int64(command), s.auditEntry(AuditSent, id, s.getvalue(id), value, o))
 	if err != nil {
 		return err
 	}
@@ -292,34 +407,49 @@ func (s *sw) setvalue(id int32, value int64) (err error) {
 	sm.Lock()
 	s.Value[id] = value
 	sm.Unlock()
-	s.mhpSaveSettings()
+	stateChanged()
 	return
 }
 
 // Function returns the command to turn the 8 on/off switches on or off. id is from 0 to 7
-func MhpSetOnOff(id int32, state bool) (err error) {
+func MhpSetOnOff(hub int, id int32, state bool, o changeOrigin) (err error) {
+	if err = checkHub(hub); err != nil {
+		return
+	}
+	if id < 1 || id > NumOnOffSwitch {
+		err = errors.New("invalid switch number")
+		return
+	}
+	value := int64(0)
+	if state {
+		value = 1
+	}
+	h := hubs[hub]
+	return h.change(id, value, o, func() error {
+		return h.switchonoff(id, state, o)
+	})
+}
+
+// Turn a power port on or off without checking canwrite or the interlocks
+func (s *sw) switchonoff(id int32, state bool, o changeOrigin) (err error) {
 	// Examples
 	// Switch 0 on 100  (0x64)
 	// Switch 0 off 99	(0x63)
 	// ...
 	// Switch 7 on 86	(0x56)
 	// Switch 7 off 85	(0x55)
-	var command int32
-	if id < 1 || id > NumOnOffSwitch {
-		err = errors.New("invalid switch number")
-		return
-	}
-	command = 0x55 + (8-id)*2
+	command := 0x55 + (8-id)*2
 	// If the switch is to be turned on, add 1
+	value := int64(0)
 	if state {
 		command++
+		value = 1
 	}
-	err = hidSend(int64(command))
+	err = s.hidSend(int64(command), s.auditEntry(AuditSent, id, s.getvalue(id), value, o))
 	if err != nil {
 		return err
 	}
-	err = s.setonoff(id, state)
-	return
+	return s.setonoff(id, state)
 }
 
 func (s *sw) setonoff(id int32, state bool) (err error) {
@@ -330,22 +460,28 @@ func (s *sw) setonoff(id int32, state bool) (err error) {
 		s.Value[id] = 0
 	}
 	sm.Unlock()
-	s.mhpSaveSettings()
+	stateChanged()
 	// fmt.Println("SetOnOff ID", id, " State ", state)
 	return
 }
 
 // Move the focuser
-func MhpMove(value int32) (err error) {
-	if value < 0 || value > s.Focusermaxstep {
+func MhpMove(hub int, value int32, o changeOrigin) (err error) {
+	if err = checkHub(hub); err != nil {
+		return
+	}
+	if value < 0 || value > MhpGetMaxStep(hub) {
 		err = errors.New("invalid focuser position")
 		return
 	}
 	// Move the focuser
-	return s.mhpmove(value)
+	h := hubs[hub]
+	return h.change(0, int64(value), o, func() error {
+		return h.mhpmove(value, o)
+	})
 }
 
-func (s *sw) mhpmove(value int32) (err error) {
+func (s *sw) mhpmove(value int32, o changeOrigin) (err error) {
 	// Examples				Hex
 	// In 1 step 50% speed		4e 8e 00 01
 	// Out 1 step 50% speed				4c 8e 00 01
@@ -382,20 +518,71 @@ func (s *sw) mhpmove(value int32) (err error) {
 	var command int64 = (value2 * 0x1000000) + (value1 * 0x10000) + part1
 
 	log.Println("Move focuser to position:", value, " steps: (+ve is out,-ve is in):", int64(value)-current, "Speed: ", s.Focucerspeed)
-	err = hidSend(command)
+	e := s.auditEntry(AuditSent, 0, current, int64(value), o)
+	e.Delta = int64(value) - current
+	err = s.hidSend(command, e)
 	if err != nil {
 		return err
 	}
 
 	sm.Lock()
 	s.Focucerposition = value
+	s.moveEnds = time.Now().Add(time.Duration(part2*speed)*focuserStepTime + focuserSettleTime)
 	sm.Unlock()
-	s.mhpSaveSettings()
+	stateChanged()
+	metricsFocuserMove(e.Hub)
 	return
 }
 
-func MhpGetMaxStep() int32 {
-	return s.getmaxstep()
+// The outputs and limits of a hub at one moment, for the MQTT bridge and the INDI server to
+// publish what has changed
+type hubState struct {
+	names        [13]string
+	values       [13]int64
+	min          [13]int64
+	max          [13]int64
+	step         [13]int64
+	canWrite     [13]bool
+	automatic    [NumVarSwitch]bool // dew heaters under automatic control
+	position     int32
+	moving       bool // the focuser is still thought to be moving to position
+	maxStep      int32
+	maxIncrement int32
+}
+
+func (s *sw) snapshot() (st hubState) {
+	sm.Lock()
+	defer sm.Unlock()
+	for id := int32(0); id <= NumSwitches; id++ {
+		st.names[id] = s.channelName(id)
+	}
+	for n := range st.automatic {
+		st.automatic[n] = s.Dewheaters[n].Mode == DewAuto
+	}
+	st.values = s.Value
+	st.min = s.Min
+	st.max = s.Max
+	st.step = s.Step
+	st.canWrite = s.Canwrite
+	st.position = s.Focucerposition
+	st.moving = time.Now().Before(s.moveEnds)
+	st.maxStep = s.Focusermaxstep
+	st.maxIncrement = s.Focusermaxincrement
+	return
+}
+
+func MhpGetBootOnStart(hub int) bool {
+	return hubs[hub].getbootonstart()
+}
+
+func (s *sw) getbootonstart() bool {
+	sm.Lock()
+	defer sm.Unlock()
+	return s.Bootonstart
+}
+
+func MhpGetMaxStep(hub int) int32 {
+	return hubs[hub].getmaxstep()
 }
 
 func (s *sw) getmaxstep() int32 {
@@ -404,8 +591,8 @@ func (s *sw) getmaxstep() int32 {
 	return s.Focusermaxstep
 }
 
-func MhpGetMaxIncrement() int32 {
-	return s.getmaxincrement()
+func MhpGetMaxIncrement(hub int) int32 {
+	return hubs[hub].getmaxincrement()
 }
 
 func (s *sw) getmaxincrement() int32 {
@@ -414,8 +601,8 @@ func (s *sw) getmaxincrement() int32 {
 	return s.Focusermaxincrement
 }
 
-func MhpGetPosition() int32 {
-	return s.getposition()
+func MhpGetPosition(hub int) int32 {
+	return hubs[hub].getposition()
 }
 
 func (s *sw) getposition() int32 {
@@ -423,3 +610,126 @@ func (s *sw) getposition() int32 {
 	defer sm.Unlock()
 	return s.Focucerposition
 }
+
+// Apply the shutdown policy of each hub, save the state and release the hubs. Anything else that
+// changes the outputs must have stopped, boot sequences are stopped and waited for here.
+func MhpShutdown() {
+	for hub := range hubs {
+		MhpStopBootSequence(hub)
+	}
+	bootRunning.Wait()
+	for _, h := range hubs {
+		// No change in progress can be interleaved with the policy
+		h.changes.Lock()
+		sm.Lock()
+		policy := h.Shutdownpolicy
+		sm.Unlock()
+
+		switch policy {
+		case ShutdownAllOff:
+			for id := int32(1); id <= NumOnOffSwitch; id++ {
+				if err := h.switchonoff(id, false, localOrigin(SourceShutdown)); err != nil {
+					log.Println("Unable to turn off switch", id, ":", err)
+				}
+			}
+			fallthrough
+		case ShutdownDewOff:
+			for id := int32(NumOnOffSwitch + 1); id <= NumSwitches; id++ {
+				if err := h.setvalue(id, 0, localOrigin(SourceShutdown)); err != nil {
+					log.Println("Unable to turn off dew heater", id-NumOnOffSwitch, ":", err)
+				}
+			}
+		case ShutdownLeave, "":
+		default:
+			log.Println("Unknown shutdown policy", policy, "- leaving outputs as they are")
+		}
+		h.changes.Unlock()
+	}
+
+	MhpStopStateWriter()
+	for _, h := range hubs {
+		h.hidClose()
+	}
+}
+
+// Wait for the hub to be plugged in, then send it the outputs selected by the startup mode.
+// Gives up quietly if ctx is cancelled first.
+func MhpRestore(ctx context.Context, hub int) {
+	h := hubs[hub]
+	sm.Lock()
+	mode := h.Startupmode
+	recorded := h.Value
+	defaults := h.Default
+	sm.Unlock()
+
+	var desired [13]int64
+	switch mode {
+	case StartupNone:
+		return
+	case StartupRestore, "":
+		desired = recorded
+	case StartupAllOff:
+		// desired is already all zero
+	case StartupDefault:
+		desired = defaults
+	default:
+		log.Println("Unknown startup mode", mode, "- not restoring hub outputs")
+		return
+	}
+
+	if !h.waitForHub(ctx) {
+		return
+	}
+
+	log.Println("Restoring outputs of hub", hub, "startup mode:", mode)
+	for id := int32(1); id <= NumSwitches; id++ {
+		if id > NumOnOffSwitch && h.dewAutomatic(id-NumOnOffSwitch) {
+			// Set by the dew controller
+			continue
+		}
+		restored, err := h.restoreChannel(id, recorded[id], desired[id])
+		if !restored {
+			log.Println("Not restoring", MhpGetName(hub, id), "- changed while waiting for the hub")
+			continue
+		}
+		if err != nil {
+			log.Println("Unable to restore", MhpGetName(hub, id), ":", err)
+			continue
+		}
+		if desired[id] != recorded[id] {
+			log.Println("Restored", MhpGetName(hub, id), "to", desired[id], "(was recorded as", recorded[id], ")")
+		} else {
+			log.Println("Restored", MhpGetName(hub, id), "to", desired[id])
+		}
+	}
+}
+
+// Send channel id its startup value unless it has been changed since recorded was read, which
+// a client may have done while the driver waited for the hub. restored is false if it was.
+func (s *sw) restoreChannel(id int32, recorded int64, desired int64) (restored bool, err error) {
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	if s.getvalue(id) != recorded {
+		return false, nil
+	}
+	if id <= NumOnOffSwitch {
+		return true, s.switchonoff(id, desired != 0, localOrigin(SourceStartup))
+	}
+	return true, s.setvalue(id, desired, localOrigin(SourceStartup))
+}
+
+// Block until the hub is plugged in. Returns false if ctx is cancelled first.
+func (s *sw) waitForHub(ctx context.Context) bool {
+	if s.hidPresent() {
+		return true
+	}
+	log.Println("Waiting for the", s.hidName(), "to be plugged in")
+	for !s.hidPresent() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return true
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small MQTT 3.1.1 client, enough for the Home Assistant bridge in mqttbridge.go: connect with
+// a last will, publish at QoS 0 with or without retain, and subscribe at QoS 0.
+// See https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html
+
+// Control packet types
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+const mqttDialTimeout = 10 * time.Second
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorised",
+}
+
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+type mqttOptions struct {
+	Broker    string // host:port, tcp://host:port or tls://host:port
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	Will      *mqttMessage // published by the broker if the connection drops
+}
+
+type mqttClient struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	keepAlive time.Duration
+	writeMu   sync.Mutex
+	nextID    uint16
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error // why the connection ended, valid once done is closed
+}
+
+// Connect to the broker. Messages on subscribed topics are passed to handle with the client, one
+// at a time, until the connection ends; Done is closed then.
+func mqttDial(opts mqttOptions, handle func(*mqttClient, mqttMessage)) (*mqttClient, error) {
+	scheme, addr, found := strings.Cut(opts.Broker, "://")
+	if !found {
+		scheme, addr = "tcp", opts.Broker
+	}
+	secure := false
+	switch scheme {
+	case "tcp", "mqtt":
+	case "tls", "ssl", "mqtts":
+		secure = true
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q, use tcp or tls", scheme)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "1883"
+		if secure {
+			port = "8883"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	var conn net.Conn
+	var err error
+	if secure {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newMqttClient(conn, opts, handle)
+}
+
+// Connect over a connection already open to the broker
+func newMqttClient(conn net.Conn, opts mqttOptions, handle func(*mqttClient, mqttMessage)) (*mqttClient, error) {
+	c := &mqttClient{conn: conn, r: bufio.NewReader(conn), keepAlive: opts.KeepAlive, done: make(chan struct{})}
+	if err := c.connect(opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop(handle)
+	go c.pingLoop()
+	return c, nil
+}
+
+func (c *mqttClient) connect(opts mqttOptions) error {
+	flags := byte(0x02) // clean session
+	var payload []byte
+	payload = appendMqttString(payload, opts.ClientID)
+	if w := opts.Will; w != nil {
+		flags |= 0x04 | 0x08 // will flag, will QoS 1
+		if w.Retain {
+			flags |= 0x20
+		}
+		payload = appendMqttString(payload, w.Topic)
+		payload = appendMqttBytes(payload, w.Payload)
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		payload = appendMqttString(payload, opts.Username)
+		if opts.Password != "" {
+			flags |= 0x40
+			payload = appendMqttString(payload, opts.Password)
+		}
+	}
+	var header []byte
+	header = appendMqttString(header, "MQTT")
+	header = append(header, 4, flags) // protocol level 3.1.1
+	header = binary.BigEndian.AppendUint16(header, uint16(opts.KeepAlive/time.Second))
+	if err := c.write(mqttConnect<<4, append(header, payload...)); err != nil {
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(mqttDialTimeout))
+	kind, body, err := readMqttPacket(c.r)
+	if err != nil {
+		return fmt.Errorf("no reply to connect: %w", err)
+	}
+	if kind>>4 != mqttConnack || len(body) < 2 {
+		return fmt.Errorf("unexpected reply to connect, packet type %d", kind>>4)
+	}
+	if code := body[1]; code != 0 {
+		if msg, ok := mqttConnackErrors[code]; ok {
+			return fmt.Errorf("connection refused: %s", msg)
+		}
+		return fmt.Errorf("connection refused, code %d", code)
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	return nil
+}
+
+// Publish at QoS 0
+func (c *mqttClient) Publish(topic string, payload []byte, retain bool) error {
+	var body []byte
+	body = appendMqttString(body, topic)
+	body = append(body, payload...)
+	flags := byte(0)
+	if retain {
+		flags = 0x01
+	}
+	return c.write(mqttPublish<<4|flags, body)
+}
+
+// Subscribe at QoS 0 to topic filters, which may contain + and # wildcards
+func (c *mqttClient) Subscribe(filters ...string) error {
+	c.writeMu.Lock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	c.writeMu.Unlock()
+
+	body := binary.BigEndian.AppendUint16(nil, id)
+	for _, f := range filters {
+		body = appendMqttString(body, f)
+		body = append(body, 0) // QoS 0
+	}
+	return c.write(mqttSubscribe<<4|0x02, body)
+}
+
+// Disconnect cleanly, so the broker does not publish the last will
+func (c *mqttClient) Disconnect() {
+	c.write(mqttDisconnect<<4, nil)
+	c.close(errors.New("disconnected"))
+}
+
+// Closed when the connection has ended
+func (c *mqttClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Why the connection ended, once Done is closed
+func (c *mqttClient) Err() error {
+	<-c.done
+	return c.err
+}
+
+func (c *mqttClient) close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+func (c *mqttClient) write(kind byte, body []byte) error {
+	packet := append([]byte{kind}, appendMqttLength(nil, len(body))...)
+	packet = append(packet, body...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(mqttDialTimeout))
+	_, err := c.conn.Write(packet)
+	if err != nil {
+		c.close(err)
+	}
+	return err
+}
+
+func (c *mqttClient) readLoop(handle func(*mqttClient, mqttMessage)) {
+	for {
+		// The broker answers each ping, so silence for 1.5 keep alive periods means the connection is gone
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		kind, body, err := readMqttPacket(c.r)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		switch kind >> 4 {
+		case mqttPublish:
+			msg, id, err := parseMqttPublish(kind, body)
+			if err != nil {
+				c.close(err)
+				return
+			}
+			if id != 0 {
+				c.write(mqttPuback<<4, binary.BigEndian.AppendUint16(nil, id))
+			}
+			handle(c, msg)
+		case mqttSuback:
+			if len(body) > 2 && body[2] == 0x80 {
+				c.close(errors.New("subscription refused by the broker"))
+				return
+			}
+		case mqttPingresp, mqttPuback:
+		default:
+			c.close(fmt.Errorf("unexpected packet type %d", kind>>4))
+			return
+		}
+	}
+}
+
+func (c *mqttClient) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if c.write(mqttPingreq<<4, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+func readMqttPacket(r *bufio.Reader) (kind byte, body []byte, err error) {
+	kind, err = r.ReadByte()
+	if err != nil {
+		return
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	body = make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+func parseMqttPublish(kind byte, body []byte) (msg mqttMessage, id uint16, err error) {
+	if len(body) < 2 {
+		return msg, 0, errors.New("short publish packet")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return msg, 0, errors.New("short publish packet")
+	}
+	msg.Topic = string(body[2 : 2+n])
+	body = body[2+n:]
+	if qos := (kind >> 1) & 0x03; qos > 0 {
+		if len(body) < 2 {
+			return msg, 0, errors.New("short publish packet")
+		}
+		id = binary.BigEndian.Uint16(body)
+		body = body[2:]
+	}
+	msg.Payload = body
+	msg.Retain = kind&0x01 != 0
+	return msg, id, nil
+}
+
+func appendMqttLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendMqttString(b []byte, s string) []byte {
+	return appendMqttBytes(b, []byte(s))
+}
+
+func appendMqttBytes(b []byte, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMqttLength(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		got := appendMqttLength(nil, tt.n)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("appendMqttLength(%d) = % x, want % x", tt.n, got, tt.want)
+			continue
+		}
+		// And back again through a whole packet
+		packet := append([]byte{mqttPublish << 4}, got...)
+		packet = append(packet, make([]byte, tt.n)...)
+		kind, body, err := readMqttPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || kind != mqttPublish<<4 || len(body) != tt.n {
+			t.Errorf("readMqttPacket with length %d: kind %#x, %d bytes, %v", tt.n, kind, len(body), err)
+		}
+	}
+}
+
+func TestReadMqttPacketMalformedLength(t *testing.T) {
+	packet := []byte{mqttPublish << 4, 0x80, 0x80, 0x80, 0x80, 0x01}
+	if _, _, err := readMqttPacket(bufio.NewReader(bytes.NewReader(packet))); err == nil {
+		t.Error("readMqttPacket accepted a remaining length of five bytes")
+	}
+}
+
+func TestParseMqttPublish(t *testing.T) {
+	topic := appendMqttString(nil, "mhp/0/switch/2/set")
+	tests := []struct {
+		name    string
+		kind    byte
+		body    []byte
+		want    mqttMessage
+		id      uint16
+		wantErr bool
+	}{
+		{
+			name: "qos 0",
+			kind: mqttPublish << 4,
+			body: append(append([]byte{}, topic...), "ON"...),
+			want: mqttMessage{Topic: "mhp/0/switch/2/set", Payload: []byte("ON")},
+		},
+		{
+			name: "qos 0 retained",
+			kind: mqttPublish<<4 | 0x01,
+			body: append(append([]byte{}, topic...), "OFF"...),
+			want: mqttMessage{Topic: "mhp/0/switch/2/set", Payload: []byte("OFF"), Retain: true},
+		},
+		{
+			name: "qos 1",
+			kind: mqttPublish<<4 | 0x02,
+			body: append(append(append([]byte{}, topic...), 0x12, 0x34), "ON"...),
+			want: mqttMessage{Topic: "mhp/0/switch/2/set", Payload: []byte("ON")},
+			id:   0x1234,
+		},
+		{
+			name: "qos 1 empty payload",
+			kind: mqttPublish<<4 | 0x02,
+			body: append(append([]byte{}, topic...), 0x00, 0x07),
+			want: mqttMessage{Topic: "mhp/0/switch/2/set", Payload: []byte{}},
+			id:   7,
+		},
+		{name: "no topic length", kind: mqttPublish << 4, body: []byte{0x00}, wantErr: true},
+		{name: "topic cut short", kind: mqttPublish << 4, body: []byte{0x00, 0x05, 'm', 'h'}, wantErr: true},
+		{name: "qos 1 without id", kind: mqttPublish<<4 | 0x02, body: append(append([]byte{}, topic...), 0x00), wantErr: true},
+	}
+	for _, tt := range tests {
+		msg, id, err := parseMqttPublish(tt.kind, tt.body)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if msg.Topic != tt.want.Topic || !bytes.Equal(msg.Payload, tt.want.Payload) || msg.Retain != tt.want.Retain || id != tt.id {
+			t.Errorf("%s: got %q %q retain %v id %d, want %q %q retain %v id %d", tt.name,
+				msg.Topic, msg.Payload, msg.Retain, id, tt.want.Topic, tt.want.Payload, tt.want.Retain, tt.id)
+		}
+	}
+}
+
+// The broker end of a connection to a client under test
+type fakeBroker struct {
+	t       *testing.T
+	conn    net.Conn
+	packets chan fakePacket // everything the client sends after CONNECT
+}
+
+type fakePacket struct {
+	kind byte
+	body []byte
+}
+
+func (fb *fakeBroker) write(kind byte, body []byte) {
+	packet := append([]byte{kind}, appendMqttLength(nil, len(body))...)
+	if _, err := fb.conn.Write(append(packet, body...)); err != nil {
+		fb.t.Errorf("broker write: %v", err)
+	}
+}
+
+func (fb *fakeBroker) publish(topic string, payload string, kind byte, id uint16) {
+	body := appendMqttString(nil, topic)
+	if id != 0 {
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	fb.write(kind, append(body, payload...))
+}
+
+func (fb *fakeBroker) expect(kind byte) fakePacket {
+	fb.t.Helper()
+	for {
+		select {
+		case p := <-fb.packets:
+			if p.kind>>4 == kind {
+				return p
+			}
+		case <-time.After(5 * time.Second):
+			fb.t.Fatalf("broker: no packet of type %d", kind)
+		}
+	}
+}
+
+// Start a client on one end of a pipe with a broker on the other that accepts its CONNECT
+// and passes on whatever else it sends
+func startFakeBroker(t *testing.T, opts mqttOptions, handle func(*mqttClient, mqttMessage)) (*mqttClient, *fakeBroker) {
+	clientConn, brokerConn := net.Pipe()
+	fb := &fakeBroker{t: t, conn: brokerConn, packets: make(chan fakePacket, 100)}
+	connect := make(chan fakePacket, 1)
+	go func() {
+		r := bufio.NewReader(brokerConn)
+		kind, body, err := readMqttPacket(r)
+		if err != nil {
+			close(connect)
+			return
+		}
+		connect <- fakePacket{kind, body}
+		fb.write(mqttConnack<<4, []byte{0, 0})
+		for {
+			kind, body, err := readMqttPacket(r)
+			if err != nil {
+				return
+			}
+			fb.packets <- fakePacket{kind, body}
+		}
+	}()
+
+	c, err := newMqttClient(clientConn, opts, handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.close(errors.New("test over"))
+		brokerConn.Close()
+	})
+
+	p, ok := <-connect
+	if !ok || p.kind != mqttConnect<<4 {
+		t.Fatalf("broker: no CONNECT, got %#x", p.kind)
+	}
+	// Protocol name, level, flags: clean session, will with QoS 1 and retain
+	want := append(appendMqttString(nil, "MQTT"), 4, 0x02|0x04|0x08|0x20)
+	if !bytes.HasPrefix(p.body, want) {
+		t.Errorf("CONNECT header = % x, want % x", p.body[:min(len(p.body), len(want))], want)
+	}
+	return c, fb
+}
+
+type bridgeCall struct {
+	what  string
+	hub   int
+	id    int32
+	value int64
+	o     changeOrigin
+}
+
+func TestMqttBridgeCommands(t *testing.T) {
+	saved := hubs
+	hubs = []*sw{new(sw)}
+	t.Cleanup(func() { hubs = saved })
+
+	calls := make(chan bridgeCall, 10)
+	b := newMQTTBridge(defaultMQTTConfig())
+	b.config.Broker = "broker.test:1883"
+	b.setOnOff = func(hub int, id int32, state bool, o changeOrigin) error {
+		value := int64(0)
+		if state {
+			value = 1
+		}
+		calls <- bridgeCall{"onoff", hub, id, value, o}
+		if !state {
+			return refused("Switch %d is critical", id)
+		}
+		return nil
+	}
+	b.setValue = func(hub int, id int32, value int64, o changeOrigin) error {
+		calls <- bridgeCall{"value", hub, id, value, o}
+		return nil
+	}
+	b.move = func(hub int, value int32, o changeOrigin) error {
+		calls <- bridgeCall{"move", hub, 0, int64(value), o}
+		return nil
+	}
+
+	opts := mqttOptions{
+		ClientID:  "mhp",
+		KeepAlive: time.Minute,
+		Will:      &mqttMessage{Topic: b.topic("status"), Payload: []byte("offline"), Retain: true},
+	}
+	// Commands are answered through the client they came in on, b.client is left unset
+	c, fb := startFakeBroker(t, opts, b.handleCommand)
+
+	if err := c.Subscribe(b.topic("+", "switch", "+", "set")); err != nil {
+		t.Fatal(err)
+	}
+	sub := fb.expect(mqttSubscribe)
+	fb.write(mqttSuback<<4, append(sub.body[:2:2], 0))
+
+	next := func() bridgeCall {
+		t.Helper()
+		select {
+		case call := <-calls:
+			return call
+		case <-time.After(5 * time.Second):
+			t.Fatal("command not dispatched")
+		}
+		return bridgeCall{}
+	}
+
+	// Retained commands are replayed by the broker on every connect and must be ignored;
+	// the ON after it is only seen if the retained one was skipped
+	fb.publish("mhp/0/switch/3/set", "ON", mqttPublish<<4|0x01, 0)
+	fb.publish("mhp/0/switch/2/set", "ON", mqttPublish<<4, 0)
+	if call := next(); call.what != "onoff" || call.hub != 0 || call.id != 2 || call.value != 1 {
+		t.Errorf("switch command dispatched as %+v", call)
+	} else if call.o.Source != SourceMQTT || call.o.Address != "broker.test:1883" {
+		t.Errorf("switch command origin %+v", call.o)
+	}
+
+	// QoS 1 is acknowledged
+	fb.publish("mhp/0/dew/1/set", "40.4", mqttPublish<<4|0x02, 9)
+	if call := next(); call.what != "value" || call.id != NumOnOffSwitch+1 || call.value != 40 {
+		t.Errorf("dew command dispatched as %+v", call)
+	}
+	if ack := fb.expect(mqttPuback); binary.BigEndian.Uint16(ack.body) != 9 {
+		t.Errorf("PUBACK for packet %d, want 9", binary.BigEndian.Uint16(ack.body))
+	}
+
+	fb.publish("mhp/0/focuser/set", "1200", mqttPublish<<4, 0)
+	if call := next(); call.what != "move" || call.value != 1200 {
+		t.Errorf("focuser command dispatched as %+v", call)
+	}
+
+	// Unknown hubs and topics are not dispatched; a refusal is published on the error topic
+	fb.publish("mhp/5/switch/2/set", "ON", mqttPublish<<4, 0)
+	fb.publish("mhp/0/switch/2/set", "confirm 1a2b3c4d", mqttPublish<<4, 0)
+	call := next()
+	if call.what != "onoff" || call.value != 0 || call.o.Token != "1a2b3c4d" {
+		t.Errorf("confirm command dispatched as %+v", call)
+	}
+	p := fb.expect(mqttPublish)
+	msg, _, err := parseMqttPublish(p.kind, p.body)
+	if err != nil || msg.Topic != "mhp/0/switch/2/error" || msg.Retain || string(msg.Payload) != "Switch 2 is critical" {
+		t.Errorf("error published as %q %q retain %v, %v", msg.Topic, msg.Payload, msg.Retain, err)
+	}
+
+	select {
+	case call := <-calls:
+		t.Errorf("unexpected command %+v", call)
+	default:
+	}
+}
+
+func TestMqttCriticalNeedsToken(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// For audit.jsonl
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+	saved := hubs
+	h := new(sw)
+	h.mhpsetdefaults()
+	h.Critical[2] = true
+	h.Value[2] = 1
+	hubs = []*sw{h}
+	t.Cleanup(func() { hubs = saved })
+
+	o := changeOrigin{Source: SourceMQTT, Address: "broker.test:1883"}
+	first := h.confirmChange(2, 0, o)
+	if !isRefused(first) {
+		t.Fatalf("first OFF: %v, want a refusal", first)
+	}
+	if err := h.confirmChange(2, 0, o); !isRefused(err) {
+		t.Fatalf("repeated OFF: %v, want a refusal", err)
+	}
+	// The repeat asked again, its token is the one that counts
+	msg := h.confirmChange(2, 0, o).Error()
+	fields := strings.Fields(msg)
+	o.Token = fields[slices.Index(fields, "token")+1]
+	if err := h.confirmChange(2, 0, o); err != nil {
+		t.Errorf("confirm with token from %q: %v", msg, err)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bridge to Home Assistant over MQTT, turned on by creating mqtt.json. Each power port is
+// announced as a switch, each dew heater and the focuser position as a number, using Home
+// Assistant MQTT discovery. States are published retained as they change, commands on the set
+// topics go through MhpSetOnOff, MhpSetValue and MhpMove like those of any other client, and
+// the availability topic is set to offline by the broker if the driver goes away.
+//
+// Topics, with <prefix> from mqtt.json and <hub> the hub number:
+//
+//	<prefix>/status                   online or offline
+//	<prefix>/<hub>/switch/<1-8>/state ON or OFF, commands to .../set
+//	<prefix>/<hub>/dew/<1-4>/state    level in %, commands to .../set
+//	<prefix>/<hub>/focuser/position   position in steps, commands to <prefix>/<hub>/focuser/set
+//
+// A command that fails or is refused is answered with the reason on the error topic next to its
+// set topic, e.g. <prefix>/<hub>/switch/<1-8>/error. Turning off a critical port is confirmed by
+// sending "confirm <token>" with the token given there. Sending OFF again does not confirm it,
+// the broker does not say who published a command so the publishers cannot be told apart.
+
+const mqttFile = "mqtt.json"
+const mqttStateInterval = time.Second
+const mqttRetryMax = time.Minute
+
+const SourceMQTT = "mqtt"
+
+type mqttConfig struct {
+	Broker          string `json:"broker"` // host:port, tcp://host:port or tls://host:port
+	Clientid        string `json:"clientid"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	Topicprefix     string `json:"topicprefix"`
+	Discoveryprefix string `json:"discoveryprefix"`
+	Keepalive       int32  `json:"keepalive"` // seconds
+}
+
+func defaultMQTTConfig() mqttConfig {
+	return mqttConfig{
+		Clientid:        "mhp",
+		Topicprefix:     "mhp",
+		Discoveryprefix: "homeassistant",
+		Keepalive:       60,
+	}
+}
+
+// Read mqtt.json. ok is false if there is no such file, the bridge is then off.
+func loadMQTTConfig() (c mqttConfig, ok bool, err error) {
+	data, err := os.ReadFile(mqttFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, err
+	}
+	c = defaultMQTTConfig()
+	if p, ok := decodeStrict(mqttFile, data, &c); !ok {
+		return c, false, p
+	}
+	switch {
+	case c.Broker == "":
+		return c, false, fmt.Errorf("%s: broker must be set", mqttFile)
+	case c.Topicprefix == "" || strings.ContainsAny(c.Topicprefix, "+#"):
+		return c, false, fmt.Errorf("%s: topicprefix must be set and must not contain + or #", mqttFile)
+	case c.Keepalive < 5:
+		return c, false, fmt.Errorf("%s: keepalive must be at least 5 seconds, found %d", mqttFile, c.Keepalive)
+	}
+	return c, true, nil
+}
+
+type mqttBridge struct {
+	config mqttConfig
+	client *mqttClient // of the current session, used by the run goroutine only
+	last   []*hubState // what has been published for each hub, nil until first published
+	// What commands call: MhpSetOnOff, MhpSetValue and MhpMove, replaced in tests
+	setOnOff func(hub int, id int32, state bool, o changeOrigin) error
+	setValue func(hub int, id int32, value int64, o changeOrigin) error
+	move     func(hub int, value int32, o changeOrigin) error
+}
+
+func newMQTTBridge(config mqttConfig) *mqttBridge {
+	return &mqttBridge{config: config, setOnOff: MhpSetOnOff, setValue: MhpSetValue, move: MhpMove}
+}
+
+// Run the bridge in the background if mqtt.json exists. The returned channel is closed
+// once it has stopped after ctx is cancelled, having marked the driver offline.
+func MhpStartMQTT(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	config, ok, err := loadMQTTConfig()
+	if err != nil {
+		log.Println("MQTT bridge not started:", err)
+	}
+	if !ok {
+		close(done)
+		return done
+	}
+	go func() {
+		defer close(done)
+		newMQTTBridge(config).run(ctx)
+	}()
+	return done
+}
+
+func (b *mqttBridge) topic(parts ...string) string {
+	return b.config.Topicprefix + "/" + strings.Join(parts, "/")
+}
+
+// Keep connected to the broker, retrying with a growing delay, until ctx is cancelled
+func (b *mqttBridge) run(ctx context.Context) {
+	retry := 5 * time.Second
+	var lastErr string
+	for {
+		client, err := mqttDial(mqttOptions{
+			Broker:    b.config.Broker,
+			ClientID:  b.config.Clientid,
+			Username:  b.config.Username,
+			Password:  b.config.Password,
+			KeepAlive: time.Duration(b.config.Keepalive) * time.Second,
+			Will:      &mqttMessage{Topic: b.topic("status"), Payload: []byte("offline"), Retain: true},
+		}, b.handleCommand)
+		if err == nil {
+			log.Println("Connected to MQTT broker", b.config.Broker)
+			lastErr = ""
+			retry = 5 * time.Second
+			b.client = client
+			err = b.session(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("MQTT connection lost:", err)
+		} else if err.Error() != lastErr {
+			// Only log when the problem changes, the broker may be down for hours
+			log.Println("Unable to connect to MQTT broker", b.config.Broker, ":", err)
+			lastErr = err.Error()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, mqttRetryMax)
+	}
+}
+
+// Announce the entities, then publish state changes until ctx is cancelled or the connection ends
+func (b *mqttBridge) session(ctx context.Context) error {
+	c := b.client
+	b.last = make([]*hubState, len(hubs))
+	err := c.Subscribe(b.topic("+", "switch", "+", "set"), b.topic("+", "dew", "+", "set"), b.topic("+", "focuser", "set"))
+	if err == nil {
+		err = b.publishChanges()
+	}
+	if err == nil {
+		err = c.Publish(b.topic("status"), []byte("online"), true)
+	}
+	if err != nil {
+		c.close(err)
+		return err
+	}
+
+	ticker := time.NewTicker(mqttStateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.Publish(b.topic("status"), []byte("offline"), true)
+			c.Disconnect()
+			return ctx.Err()
+		case <-c.Done():
+			return c.Err()
+		case <-ticker.C:
+			if err := b.publishChanges(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Publish the discovery config of entities whose names or limits changed and the states that changed
+func (b *mqttBridge) publishChanges() error {
+	for hub, h := range hubs {
+		st := h.snapshot()
+		last := b.last[hub]
+		if last == nil || last.names != st.names || last.max != st.max || last.step != st.step || last.maxStep != st.maxStep {
+			if err := b.publishDiscovery(hub, h, st); err != nil {
+				return err
+			}
+			last = nil
+		}
+		n := strconv.Itoa(hub)
+		for id := int32(1); id <= NumSwitches; id++ {
+			if last != nil && last.values[id] == st.values[id] {
+				continue
+			}
+			var err error
+			if id <= NumOnOffSwitch {
+				payload := "OFF"
+				if st.values[id] != 0 {
+					payload = "ON"
+				}
+				err = b.client.Publish(b.topic(n, "switch", strconv.Itoa(int(id)), "state"), []byte(payload), true)
+			} else {
+				err = b.client.Publish(b.topic(n, "dew", strconv.Itoa(int(id-NumOnOffSwitch)), "state"), []byte(strconv.FormatInt(st.values[id], 10)), true)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if last == nil || last.position != st.position {
+			if err := b.client.Publish(b.topic(n, "focuser", "position"), []byte(strconv.Itoa(int(st.position))), true); err != nil {
+				return err
+			}
+		}
+		b.last[hub] = &st
+	}
+	return nil
+}
+
+// Home Assistant MQTT discovery config of one entity
+type haEntity struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	CommandTopic      string   `json:"command_topic"`
+	StateTopic        string   `json:"state_topic"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	Min               *float64 `json:"min,omitempty"`
+	Max               *float64 `json:"max,omitempty"`
+	Step              *float64 `json:"step,omitempty"`
+	Mode              string   `json:"mode,omitempty"`
+	Unit              string   `json:"unit_of_measurement,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+func (b *mqttBridge) publishDiscovery(hub int, h *sw, st hubState) error {
+	sm.Lock()
+	switchID, focuserID := h.Switchuniqueid, h.Focuseruniqueid
+	sm.Unlock()
+
+	device := haDevice{
+		Identifiers:  []string{switchID, focuserID},
+		Name:         "Mount Hub Pro",
+		Model:        "Mount Hub Pro",
+		Manufacturer: "HiTecAstro",
+	}
+	if len(hubs) > 1 {
+		device.Name = fmt.Sprintf("Mount Hub Pro %d", hub)
+	}
+	n := strconv.Itoa(hub)
+	float := func(v int64) *float64 {
+		f := float64(v)
+		return &f
+	}
+	publish := func(component string, objectID string, e haEntity) error {
+		e.AvailabilityTopic = b.topic("status")
+		e.Device = device
+		data, err := json.Marshal(&e)
+		if err != nil {
+			return err
+		}
+		return b.client.Publish(b.config.Discoveryprefix+"/"+component+"/"+objectID+"/config", data, true)
+	}
+
+	for id := int32(1); id <= NumSwitches; id++ {
+		var err error
+		if id <= NumOnOffSwitch {
+			port := strconv.Itoa(int(id))
+			err = publish("switch", fmt.Sprintf("%s_port%d", switchID, id), haEntity{
+				Name:         st.names[id],
+				UniqueID:     fmt.Sprintf("%s_port%d", switchID, id),
+				CommandTopic: b.topic(n, "switch", port, "set"),
+				StateTopic:   b.topic(n, "switch", port, "state"),
+				PayloadOn:    "ON",
+				PayloadOff:   "OFF",
+				Icon:         "mdi:power-socket",
+			})
+		} else {
+			heater := strconv.Itoa(int(id - NumOnOffSwitch))
+			err = publish("number", fmt.Sprintf("%s_dew%s", switchID, heater), haEntity{
+				Name:         st.names[id],
+				UniqueID:     fmt.Sprintf("%s_dew%s", switchID, heater),
+				CommandTopic: b.topic(n, "dew", heater, "set"),
+				StateTopic:   b.topic(n, "dew", heater, "state"),
+				Min:          float(0),
+				Max:          float(st.max[id]),
+				Step:         float(max(st.step[id], 1)),
+				Mode:         "slider",
+				Unit:         "%",
+				Icon:         "mdi:heat-wave",
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return publish("number", focuserID+"_position", haEntity{
+		Name:         st.names[0],
+		UniqueID:     focuserID + "_position",
+		CommandTopic: b.topic(n, "focuser", "set"),
+		StateTopic:   b.topic(n, "focuser", "position"),
+		Min:          float(0),
+		Max:          float(int64(st.maxStep)),
+		Step:         float(1),
+		Mode:         "box",
+		Icon:         "mdi:target",
+	})
+}
+
+// Carry out a command received on a set topic by c, on its read goroutine
+func (b *mqttBridge) handleCommand(c *mqttClient, msg mqttMessage) {
+	rest, found := strings.CutPrefix(msg.Topic, b.config.Topicprefix+"/")
+	if !found || msg.Retain {
+		// A retained command would be replayed on every connect
+		return
+	}
+	parts := strings.Split(rest, "/")
+	payload := strings.TrimSpace(string(msg.Payload))
+	hub, err := strconv.Atoi(parts[0])
+	if err == nil {
+		err = checkHub(hub)
+	}
+	if err != nil {
+		log.Println("MQTT command on", msg.Topic, "ignored:", err)
+		return
+	}
+	// No ClientID, so a critical port needs the token, see critical.go
+	o := changeOrigin{Source: SourceMQTT, Address: b.config.Broker}
+
+	switch {
+	case len(parts) == 4 && parts[1] == "switch" && parts[3] == "set":
+		var id int64
+		var on bool
+		if id, err = strconv.ParseInt(parts[2], 10, 32); err == nil {
+			if err = checkSwitchNumber(int32(id)); err == nil {
+				// "confirm <token>" turns off a critical port with the token from its error topic
+				if f := strings.Fields(payload); len(f) == 2 && strings.EqualFold(f[0], "confirm") {
+					o.Token = f[1]
+				} else {
+					on, err = parseOnOff(payload)
+				}
+				if err == nil {
+					err = b.setOnOff(hub, int32(id), on, o)
+				}
+			}
+		}
+	case len(parts) == 4 && parts[1] == "dew" && parts[3] == "set":
+		var id int64
+		var level float64
+		if id, err = strconv.ParseInt(parts[2], 10, 32); err == nil {
+			if err = checkDewNumber(int32(id)); err == nil {
+				if level, err = strconv.ParseFloat(payload, 64); err == nil {
+					err = b.setValue(hub, NumOnOffSwitch+int32(id), int64(math.Round(level)), o)
+				}
+			}
+		}
+	case len(parts) == 3 && parts[1] == "focuser" && parts[2] == "set":
+		var position float64
+		if position, err = strconv.ParseFloat(payload, 64); err == nil {
+			err = b.move(hub, int32(math.Round(position)), o)
+		}
+	default:
+		log.Println("MQTT command on", msg.Topic, "ignored: unknown topic")
+		return
+	}
+	if err != nil {
+		log.Printf("MQTT command %q on %s failed: %v", payload, msg.Topic, err)
+		// Let the sender know, e.g. that a critical port needs confirming
+		parts[len(parts)-1] = "error"
+		c.Publish(b.topic(parts...), []byte(err.Error()), false)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Parsing of Alpaca request parameters. Parameter names are case insensitive. GET requests
+// carry their parameters in the query string and PUT requests in the form encoded body;
+// anything in the other place is ignored, as the Alpaca API requires.
+
+// The parameters of a request from the place the Alpaca API puts them
+func alpacaParams(r *http.Request) url.Values {
+	if r.Method == http.MethodGet {
+		return r.URL.Query()
+	}
+	// Only the body, PostFormValue would also look in the query string
+	r.ParseForm()
+	return r.PostForm
+}
+
+// Value of the named parameter, matching the name without regard to case.
+// Returns "" if the parameter is missing. Requests naming a parameter twice in different cases
+// are rejected by checkAlpacaRequest, so at most one key matches.
+func alpacaParam(r *http.Request, name string) string {
+	for key, values := range alpacaParams(r) {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// Read an optional unsigned 32 bit parameter such as ClientID, which is 0 when missing
+func alpacaUint32Param(r *http.Request, name string) (uint32, error) {
+	v := alpacaParam(r, name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a whole number from 0 to 4294967295, found %q", name, v)
+	}
+	return uint32(n), nil
+}
+
+func getClientId(r *http.Request) uint32 {
+	cid, _ := alpacaUint32Param(r, "ClientID")
+	return cid
+}
+
+func getClientTransactionId(r *http.Request) uint32 {
+	ctid, _ := alpacaUint32Param(r, "ClientTransactionID")
+	return ctid
+}
+
+// Check the parts of a request common to every Alpaca method
+func checkAlpacaRequest(r *http.Request) error {
+	if r.Method == http.MethodPut {
+		if err := r.ParseForm(); err != nil {
+			return fmt.Errorf("unable to read the form parameters: %w", err)
+		}
+	}
+	seen := make(map[string]string)
+	for key := range alpacaParams(r) {
+		if other, ok := seen[strings.ToLower(key)]; ok {
+			return fmt.Errorf("parameter %s is given twice, as %s and %s", strings.ToLower(key), min(key, other), max(key, other))
+		}
+		seen[strings.ToLower(key)] = key
+	}
+	if _, err := alpacaUint32Param(r, "ClientID"); err != nil {
+		return err
+	}
+	if _, err := alpacaUint32Param(r, "ClientTransactionID"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Reject requests with malformed ClientID or ClientTransactionID, or a parameter given twice, with
+// a 400 and a plain text message
+func (srv *ApiServer) alpaca(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if err := checkAlpacaRequest(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handle(w, r, ps)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Named configuration profiles, e.g. one per rig. A profile is a copy of the configuration part
+// of settings.json, including the unique ids so that N.I.N.A. recognises the devices again when
+// the profile is used. A profile holds the settings of one hub and can be used on any of them,
+// the hub keeps its own usbpath and usbserial. Profiles are stored as json in the profiles
+// directory and can be exported to and imported from json or yaml files using the same field
+// names.
+
+const profileDir = "profiles"
+
+var profileNames = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 _.-]*$`)
+
+func profilePath(name string) (string, error) {
+	if !profileNames.MatchString(name) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid profile name %q, use letters, numbers, spaces, '.', '_' and '-'", name)
+	}
+	return filepath.Join(profileDir, name+".json"), nil
+}
+
+// List the names of the saved profiles
+func MhpListProfiles() ([]string, error) {
+	entries, err := os.ReadDir(profileDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Name of the profile the current settings of a hub came from, if any
+func MhpGetProfile(hub int) string {
+	sm.Lock()
+	defer sm.Unlock()
+	return hubs[hub].Profile
+}
+
+// Save the current configuration of a hub as a profile, replacing any profile of the same name
+func MhpSaveProfile(hub int, name string) error {
+	if err := checkHub(hub); err != nil {
+		return err
+	}
+	path, err := profilePath(name)
+	if err != nil {
+		return err
+	}
+	h := hubs[hub]
+	sm.Lock()
+	h.Profile = name
+	config := h.swconfig
+	sm.Unlock()
+	if err := writeProfile(path, &config); err != nil {
+		return err
+	}
+	return mhpSaveSettings()
+}
+
+// Replace the current configuration of a hub with a saved profile. The runtime state is not
+// changed except for channels outside their new min and max, which are brought back within them.
+func MhpUseProfile(hub int, name string) error {
+	outside, err := useProfile(hub, name)
+	if err != nil {
+		return err
+	}
+	bringWithinLimits(outside, SourceProfile)
+	return nil
+}
+
+// Replace the configuration of a hub with a saved profile and save settings.json, returning the
+// channels left outside their new limits
+func useProfile(hub int, name string) ([]outOfRange, error) {
+	if err := checkHub(hub); err != nil {
+		return nil, err
+	}
+	path, err := profilePath(name)
+	if err != nil {
+		return nil, err
+	}
+	config, err := readProfile(path)
+	if err != nil {
+		return nil, err
+	}
+	config.Profile = name
+
+	sm.Lock()
+	h := hubs[hub]
+	config.Usbpath, config.Usbserial = h.Usbpath, h.Usbserial
+	// The profile may already be in use on another hub
+	candidate := make([]*sw, len(hubs))
+	for i, other := range hubs {
+		candidate[i] = &sw{swconfig: other.swconfig}
+	}
+	candidate[hub].swconfig = *config
+	if problems := validateHubs(candidate, false); problems != nil {
+		sm.Unlock()
+		return nil, fmt.Errorf("profile %q cannot be used on hub %d:\n%w", name, hub, problems)
+	}
+	h.swconfig = *config
+	outside := h.outsideLimits()
+	sm.Unlock()
+	log.Println("Using profile", name, "on hub", hub)
+	return outside, mhpSaveSettings()
+}
+
+// Delete a saved profile
+func MhpDeleteProfile(name string) error {
+	path, err := profilePath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Write a saved profile to a json or yaml file, chosen by the file extension
+func MhpExportProfile(name string, file string) error {
+	path, err := profilePath(name)
+	if err != nil {
+		return err
+	}
+	config, err := readProfile(path)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	if isYAML(file) {
+		if data, err = jsonToYAML(data); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// Check a json or yaml profile file and save it as a profile
+func MhpImportProfile(file string, name string) error {
+	path, err := profilePath(name)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if isYAML(file) {
+		if data, err = yamlToJSON(data); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	loaded, problems := decodeHubSettings(file, data)
+	if problems != nil {
+		return problems
+	}
+	migrateSettings(loaded)
+	if problems := locateProblems(file, data, loaded.swconfig.validate()); problems != nil {
+		return problems
+	}
+	loaded.Profile = name
+	return writeProfile(path, &loaded.swconfig)
+}
+
+func readProfile(path string) (*swconfig, error) {
+	loaded, data, err := readHubSettings(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("profile %q not found", strings.TrimSuffix(filepath.Base(path), ".json"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	migrated := migrateSettings(loaded)
+	if problems := locateProblems(path, data, loaded.swconfig.validate()); problems != nil {
+		return nil, problems
+	}
+	if migrated {
+		// Save the upgrade so that generated values such as unique ids stay the same
+		if err := writeProfile(path, &loaded.swconfig); err != nil {
+			return nil, err
+		}
+	}
+	return &loaded.swconfig, nil
+}
+
+func writeProfile(path string, config *swconfig) error {
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, false)
+}
+
+func isYAML(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Convert json to block style yaml, keeping the order of the fields
+func jsonToYAML(data []byte) ([]byte, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	var blockStyle func(n *yaml.Node)
+	blockStyle = func(n *yaml.Node) {
+		// Strings are quoted again where yaml needs it
+		n.Style = 0
+		for _, c := range n.Content {
+			blockStyle(c)
+		}
+	}
+	blockStyle(&node)
+	return yaml.Marshal(&node)
+}
+
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v any
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(v, "", "    ")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Hot reload of settings.json. The file is polled for changes and can also be reloaded through
+// the management API. Only the configuration is replaced, the runtime state is left alone except
+// for channels left outside their new min and max, which are brought back within them.
+
+const settingsPollInterval = 2 * time.Second
+
+// Size and modification time of settings.json when it was last loaded or saved by the driver
+var settingsStamp struct {
+	sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+func recordSettingsStamp() {
+	info, err := os.Stat(settingsFile)
+	if err != nil {
+		return
+	}
+	settingsStamp.Lock()
+	settingsStamp.modTime = info.ModTime()
+	settingsStamp.size = info.Size()
+	settingsStamp.Unlock()
+}
+
+// Report whether settings.json has been changed by something other than the driver
+func settingsChangedOnDisk() bool {
+	info, err := os.Stat(settingsFile)
+	if err != nil {
+		return false
+	}
+	settingsStamp.Lock()
+	defer settingsStamp.Unlock()
+	return !info.ModTime().Equal(settingsStamp.modTime) || info.Size() != settingsStamp.size
+}
+
+// Reload settings.json. If it is not valid the current configuration is kept.
+// Hubs cannot be added or removed while running, that needs a restart.
+func MhpReloadSettings() error {
+	recordSettingsStamp()
+	loaded, legacy, data, err := readSettings(settingsFile)
+	if err != nil {
+		return err
+	}
+	migrated := false
+	for _, h := range loaded {
+		if migrateSettings(h) {
+			migrated = true
+		}
+	}
+	if problems := locateProblems(settingsFile, data, validateHubs(loaded, legacy)); problems != nil {
+		return problems
+	}
+	if len(loaded) != len(hubs) {
+		return fmt.Errorf("%s lists %d hub(s) but %d are in use, restart the driver to add or remove hubs", settingsFile, len(loaded), len(hubs))
+	}
+
+	var moved []*sw
+	var outside []outOfRange
+	sm.Lock()
+	for i, h := range hubs {
+		if h.Usbpath != loaded[i].Usbpath || h.Usbserial != loaded[i].Usbserial {
+			moved = append(moved, h)
+		}
+		h.swconfig = loaded[i].swconfig
+		outside = append(outside, h.outsideLimits()...)
+	}
+	sm.Unlock()
+	// Find the hubs again on their next command
+	for _, h := range moved {
+		h.hidClose()
+	}
+	log.Println("Settings reloaded from", settingsFile)
+	bringWithinLimits(outside, SourceReload)
+	if migrated {
+		// Save the upgrade so that generated values such as unique ids stay the same
+		return mhpSaveSettings()
+	}
+	return nil
+}
+
+// A channel left outside its min and max when the configuration of its hub was replaced
+type outOfRange struct {
+	h     *sw
+	id    int32
+	name  string
+	value int64
+	limit int64 // the min or max it is brought back to
+}
+
+// The channels of s outside their min and max. Caller holds sm.
+func (s *sw) outsideLimits() []outOfRange {
+	var outside []outOfRange
+	for id := int32(1); id <= NumSwitches; id++ {
+		if limit := min(max(s.Value[id], s.Min[id]), s.Max[id]); limit != s.Value[id] {
+			outside = append(outside, outOfRange{s, id, s.channelName(id), s.Value[id], limit})
+		}
+	}
+	return outside
+}
+
+// Set channels left outside their limits by a reload or a profile switch to the nearest limit
+func bringWithinLimits(outside []outOfRange, source string) {
+	for _, c := range outside {
+		log.Printf("%s of hub %d is %d, outside its new range, setting it to %d", c.name, c.h.number(), c.value, c.limit)
+		o := localOrigin(source)
+		var err error
+		c.h.changes.Lock()
+		if c.id <= NumOnOffSwitch {
+			err = c.h.switchonoff(c.id, c.limit != 0, o)
+		} else {
+			err = c.h.setvalue(c.id, c.limit, o)
+		}
+		c.h.changes.Unlock()
+		if err != nil {
+			log.Printf("Unable to set %s of hub %d to %d: %v", c.name, c.h.number(), c.limit, err)
+		}
+	}
+}
+
+// Poll settings.json and reload it when it is edited
+func MhpWatchSettings(ctx context.Context) {
+	ticker := time.NewTicker(settingsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !settingsChangedOnDisk() {
+			continue
+		}
+		if err := MhpReloadSettings(); err != nil {
+			log.Printf("WARNING: %s changed but was not reloaded, keeping the current settings:\n%v", settingsFile, err)
+		}
+	}
+}
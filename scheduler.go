@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheduler for the on/off power ports. A schedule either repeats on a cron expression or runs
+// once at a set time, such as one added by the SetSwitchAfter action to turn a port off in
+// 20 minutes. Schedules are kept in schedules.json next to settings.json so they survive a
+// restart; a one-off that fell due while the driver was stopped runs when it starts again.
+// A one-off that fails, e.g. because the hub is unplugged, is tried again with a growing delay
+// until it succeeds or is cancelled. Every change goes through MhpSetOnOff so state.json stays in
+// step with the ports.
+
+const schedulesFile = "schedules.json"
+const schedulerInterval = time.Second
+
+// Delays before a failed one-off is tried again, doubling from the first to the last
+const (
+	scheduleFirstRetry = 30 * time.Second
+	scheduleLastRetry  = 15 * time.Minute
+)
+
+// Sets the port of a due schedule, replaced in tests
+var scheduleSetOnOff = MhpSetOnOff
+
+type portSchedule struct {
+	Id    string     `json:"id"`             // generated if left empty in schedules.json
+	Hub   int        `json:"hub"`            // hub number, as for -hub and the Alpaca device number
+	Port  int32      `json:"port"`           // power port 1 to 8
+	State bool       `json:"state"`          // true to turn the port on
+	Cron  string     `json:"cron,omitempty"` // repeat, e.g. "0 22 * * *" for 22:00 every day
+	At    *time.Time `json:"at,omitempty"`   // run once, removed when done
+	Note  string     `json:"note,omitempty"`
+	Error string     `json:"error,omitempty"` // why the last run failed
+	// A failed one-off: how many times it has failed and when it is tried again
+	Failures int        `json:"failures,omitempty"`
+	Retry    *time.Time `json:"retry,omitempty"`
+}
+
+type schedulesLayout struct {
+	Schedules []portSchedule `json:"schedules"`
+}
+
+var schedules struct {
+	sync.Mutex
+	list    []portSchedule
+	modTime time.Time
+	size    int64
+	ready   map[int]bool // hubs whose outputs have been restored
+}
+
+func (ps *portSchedule) check() error {
+	if err := checkHub(ps.Hub); err != nil {
+		return err
+	}
+	if ps.Port < 1 || ps.Port > NumOnOffSwitch {
+		return fmt.Errorf("port must be 1 to %d, found %d", NumOnOffSwitch, ps.Port)
+	}
+	switch {
+	case ps.Cron != "" && ps.At != nil:
+		return errors.New("set either cron or at, not both")
+	case ps.Cron != "":
+		spec, err := parseCron(ps.Cron)
+		if err != nil {
+			return err
+		}
+		if _, ok := spec.next(time.Now()); !ok {
+			return fmt.Errorf("cron %q never runs", ps.Cron)
+		}
+	case ps.At == nil:
+		return errors.New("cron or at must be set")
+	}
+	return nil
+}
+
+// When the schedule next runs
+func (ps *portSchedule) next(now time.Time) (time.Time, bool) {
+	if ps.Retry != nil {
+		return *ps.Retry, true
+	}
+	if ps.At != nil {
+		return *ps.At, true
+	}
+	spec, err := parseCron(ps.Cron)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return spec.next(now)
+}
+
+func (ps portSchedule) String() string {
+	state := "off"
+	if ps.State {
+		state = "on"
+	}
+	when := "cron " + ps.Cron
+	if ps.At != nil {
+		when = "at " + ps.At.Local().Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprintf("%s: hub %d port %d %s %s", ps.Id, ps.Hub, ps.Port, state, when)
+}
+
+// Load schedules.json. Invalid schedules are logged and left out, they do not stop the driver.
+func MhpLoadSchedules() error {
+	schedules.Lock()
+	defer schedules.Unlock()
+	return loadSchedules()
+}
+
+// Caller must hold schedules
+func loadSchedules() error {
+	data, err := os.ReadFile(schedulesFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		schedules.list = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	recordSchedulesStamp()
+	var layout schedulesLayout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return fmt.Errorf("%s: %w", schedulesFile, err)
+	}
+
+	schedules.list = nil
+	changed := false
+	for i, ps := range layout.Schedules {
+		if err := ps.check(); err != nil {
+			log.Printf("%s: schedules[%d] ignored: %v", schedulesFile, i, err)
+			continue
+		}
+		if ps.Id == "" {
+			ps.Id = newScheduleID()
+			changed = true
+		}
+		schedules.list = append(schedules.list, ps)
+	}
+	if changed {
+		return saveSchedules()
+	}
+	return nil
+}
+
+// Caller must hold schedules
+func saveSchedules() error {
+	layout := schedulesLayout{Schedules: schedules.list}
+	if layout.Schedules == nil {
+		layout.Schedules = []portSchedule{}
+	}
+	data, err := json.MarshalIndent(&layout, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(schedulesFile, data, false); err != nil {
+		return fmt.Errorf("unable to save schedules: %w", err)
+	}
+	recordSchedulesStamp()
+	return nil
+}
+
+// Caller must hold schedules
+func recordSchedulesStamp() {
+	if info, err := os.Stat(schedulesFile); err == nil {
+		schedules.modTime = info.ModTime()
+		schedules.size = info.Size()
+	}
+}
+
+// Caller must hold schedules
+func schedulesChangedOnDisk() bool {
+	info, err := os.Stat(schedulesFile)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(schedules.modTime) || info.Size() != schedules.size
+}
+
+func newScheduleID() string {
+	return newUniqueID()[:8]
+}
+
+// Add a schedule and save it, returning it with its id filled in
+func MhpAddSchedule(ps portSchedule) (portSchedule, error) {
+	if err := ps.check(); err != nil {
+		return ps, err
+	}
+	schedules.Lock()
+	defer schedules.Unlock()
+	ps.Id = newScheduleID()
+	schedules.list = append(schedules.list, ps)
+	log.Println("Schedule added", ps)
+	return ps, saveSchedules()
+}
+
+// Remove a schedule of a hub
+func MhpCancelSchedule(hub int, id string) error {
+	schedules.Lock()
+	defer schedules.Unlock()
+	for i, ps := range schedules.list {
+		if ps.Hub == hub && ps.Id == id {
+			schedules.list = append(schedules.list[:i], schedules.list[i+1:]...)
+			log.Println("Schedule cancelled", ps)
+			return saveSchedules()
+		}
+	}
+	return fmt.Errorf("no schedule %q on hub %d", id, hub)
+}
+
+// The schedules of a hub in the order they next run
+func MhpListSchedules(hub int) []portSchedule {
+	schedules.Lock()
+	var list []portSchedule
+	for _, ps := range schedules.list {
+		if ps.Hub == hub {
+			list = append(list, ps)
+		}
+	}
+	schedules.Unlock()
+
+	// Each cron is searched once rather than on every comparison
+	type timed struct {
+		ps   portSchedule
+		next time.Time
+	}
+	now := time.Now()
+	sorted := make([]timed, len(list))
+	for i, ps := range list {
+		sorted[i].ps = ps
+		sorted[i].next, _ = ps.next(now)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].next.Before(sorted[j].next)
+	})
+	for i := range sorted {
+		list[i] = sorted[i].ps
+	}
+	return list
+}
+
+// Let the schedules of a hub run. Called once its outputs have been restored at startup so
+// a schedule that fell due while the driver was stopped is not undone by the restore.
+func MhpScheduleHub(hub int) {
+	schedules.Lock()
+	defer schedules.Unlock()
+	if schedules.ready == nil {
+		schedules.ready = make(map[int]bool)
+	}
+	schedules.ready[hub] = true
+}
+
+// Run schedules as they fall due until ctx is cancelled
+func MhpRunScheduler(ctx context.Context) {
+	lastMinute := time.Now().Truncate(time.Minute)
+	for {
+		now := time.Now()
+		minute := now.Truncate(time.Minute)
+		runDueSchedules(now, minute.After(lastMinute))
+		lastMinute = minute
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(schedulerInterval):
+		}
+	}
+}
+
+// Run the one-off schedules that are due and, at the start of a minute, the cron schedules matching it
+func runDueSchedules(now time.Time, newMinute bool) {
+	schedules.Lock()
+	if schedulesChangedOnDisk() {
+		log.Println("Reloading", schedulesFile)
+		if err := loadSchedules(); err != nil {
+			log.Println(err)
+		}
+	}
+	var due []portSchedule
+	for _, ps := range schedules.list {
+		switch {
+		case !schedules.ready[ps.Hub]:
+		case ps.At != nil:
+			if at, _ := ps.next(now); !now.Before(at) {
+				due = append(due, ps)
+			}
+		case ps.Cron != "" && newMinute:
+			if spec, err := parseCron(ps.Cron); err == nil && spec.matches(now) {
+				due = append(due, ps)
+			}
+		}
+	}
+	schedules.Unlock()
+
+	for _, ps := range due {
+		switch {
+		case ps.Failures > 0:
+			log.Println("Trying failed schedule again:", ps)
+		case ps.At != nil && now.Sub(*ps.At) > time.Minute:
+			log.Println("Running schedule that fell due while the driver was stopped:", ps)
+		default:
+			log.Println("Running schedule", ps)
+		}
+		err := scheduleSetOnOff(ps.Hub, ps.Port, ps.State, localOrigin(SourceSchedule))
+		if err != nil {
+			log.Println("Schedule", ps.Id, "failed:", err)
+		}
+		finishSchedule(ps, err, now)
+	}
+}
+
+// The delay before a one-off that has failed the given number of times is tried again
+func scheduleRetryDelay(failures int) time.Duration {
+	delay := scheduleFirstRetry
+	for n := 1; n < failures && delay < scheduleLastRetry; n++ {
+		delay *= 2
+	}
+	return min(delay, scheduleLastRetry)
+}
+
+// Record how a schedule that ran at now went. A one-off is removed once it has succeeded; if it
+// failed it is kept with the error, so that it is listed, and tried again later.
+func finishSchedule(ps portSchedule, err error, now time.Time) {
+	schedules.Lock()
+	defer schedules.Unlock()
+	for i := range schedules.list {
+		p := &schedules.list[i]
+		if p.Hub != ps.Hub || p.Id != ps.Id {
+			continue
+		}
+		switch {
+		case err != nil && p.At != nil:
+			p.Error = err.Error()
+			p.Failures++
+			retry := now.Add(scheduleRetryDelay(p.Failures))
+			p.Retry = &retry
+			log.Println("Schedule", p.Id, "will be tried again at", retry.Local().Format("15:04:05"))
+		case err != nil && p.Error == err.Error():
+			return
+		case err != nil:
+			p.Error = err.Error()
+		case p.At != nil:
+			schedules.list = append(schedules.list[:i], schedules.list[i+1:]...)
+		case p.Error != "":
+			p.Error = ""
+		default:
+			return
+		}
+		if err := saveSchedules(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+}
+
+// Parse the parameters of the SetSwitchAfter action: "<id> <on|off> <delay>", where delay is a
+// duration such as 20m or 1h30m
+func parseSetSwitchAfter(hub int, parameters string) (portSchedule, error) {
+	fields := strings.Fields(parameters)
+	if len(fields) != 3 {
+		return portSchedule{}, errors.New(`parameters must be "<id> <on|off> <delay>", e.g. "2 off 20m"`)
+	}
+	ps, err := parsePortState(hub, fields[0], fields[1])
+	if err != nil {
+		return ps, err
+	}
+	delay, err := time.ParseDuration(fields[2])
+	if err != nil || delay < 0 {
+		return ps, fmt.Errorf("invalid delay %q, use e.g. 90s, 20m or 1h30m", fields[2])
+	}
+	at := time.Now().Add(delay)
+	ps.At = &at
+	return ps, nil
+}
+
+// Parse the parameters of the SetSwitchCron action: "<id> <on|off> <cron>", e.g. "2 off 0 6 * * *"
+// to turn the third port off at 06:00 every day
+func parseSetSwitchCron(hub int, parameters string) (portSchedule, error) {
+	fields := strings.Fields(parameters)
+	if len(fields) != 2+len(cronFields) {
+		return portSchedule{}, errors.New(`parameters must be "<id> <on|off> <cron>", e.g. "2 off 0 6 * * *"`)
+	}
+	ps, err := parsePortState(hub, fields[0], fields[1])
+	ps.Cron = strings.Join(fields[2:], " ")
+	return ps, err
+}
+
+// The port and state of a schedule from an Alpaca switch id of a power port, 0 to 7, and on or off
+func parsePortState(hub int, id string, state string) (portSchedule, error) {
+	ps := portSchedule{Hub: hub}
+	port, err := parseSwitchId(id)
+	if err != nil {
+		return ps, err
+	}
+	ps.Port = port
+	ps.State, err = parseOnOff(state)
+	return ps, err
+}
+
+// The switch number, 1 to 8, of a power port given as an Alpaca switch id, 0 to 7, in action parameters
+func parseSwitchId(id string) (int32, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(id), 10, 32)
+	if err != nil || n < 0 || n >= NumOnOffSwitch {
+		return 0, fmt.Errorf("id must be a power port from 0 to %d, found %q", NumOnOffSwitch-1, id)
+	}
+	return int32(n) + 1, nil
+}
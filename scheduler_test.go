@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScheduleRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{6, 15 * time.Minute},
+		{100, 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := scheduleRetryDelay(tt.failures); got != tt.want {
+			t.Errorf("scheduleRetryDelay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+type scheduledCall struct {
+	hub   int
+	port  int32
+	state bool
+}
+
+// Run the scheduler on the given schedules in a temporary directory, with the ports set by a fake
+// that returns the next of results on each call
+func startFakeScheduler(t *testing.T, list []portSchedule, results ...error) *[]scheduledCall {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	savedSet := scheduleSetOnOff
+	t.Cleanup(func() {
+		os.Chdir(dir)
+		scheduleSetOnOff = savedSet
+		schedules.Lock()
+		schedules.list, schedules.ready = nil, nil
+		schedules.modTime, schedules.size = time.Time{}, 0
+		schedules.Unlock()
+	})
+
+	calls := new([]scheduledCall)
+	scheduleSetOnOff = func(hub int, id int32, state bool, o changeOrigin) error {
+		if o.Source != SourceSchedule {
+			t.Errorf("schedule ran with source %q", o.Source)
+		}
+		*calls = append(*calls, scheduledCall{hub, id, state})
+		if len(results) == 0 {
+			return nil
+		}
+		err := results[0]
+		results = results[1:]
+		return err
+	}
+	schedules.Lock()
+	schedules.list = list
+	schedules.ready = map[int]bool{0: true}
+	if err := saveSchedules(); err != nil {
+		t.Fatal(err)
+	}
+	schedules.Unlock()
+	return calls
+}
+
+func currentSchedules() []portSchedule {
+	schedules.Lock()
+	defer schedules.Unlock()
+	return append([]portSchedule(nil), schedules.list...)
+}
+
+func savedSchedules(t *testing.T) []portSchedule {
+	t.Helper()
+	data, err := os.ReadFile(schedulesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layout schedulesLayout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		t.Fatal(err)
+	}
+	return layout.Schedules
+}
+
+func TestOneOffScheduleRetried(t *testing.T) {
+	t0 := time.Date(2026, 3, 14, 23, 30, 0, 0, time.Local)
+	unplugged := errors.New("hub not found")
+	calls := startFakeScheduler(t, []portSchedule{{Id: "a", Hub: 0, Port: 3, At: &t0}}, unplugged, unplugged)
+
+	steps := []struct {
+		at       time.Duration // after t0
+		calls    int
+		failures int
+		retry    time.Duration // after t0, 0 once removed
+	}{
+		{-time.Second, 0, 0, 0},
+		{0, 1, 1, 30 * time.Second},
+		{10 * time.Second, 1, 1, 30 * time.Second},
+		{30 * time.Second, 2, 2, 90 * time.Second},
+		{89 * time.Second, 2, 2, 90 * time.Second},
+		{90 * time.Second, 3, 0, 0},
+	}
+	for _, step := range steps {
+		runDueSchedules(t0.Add(step.at), false)
+		if len(*calls) != step.calls {
+			t.Fatalf("at %s: %d runs, want %d", step.at, len(*calls), step.calls)
+		}
+		list := currentSchedules()
+		switch {
+		case step.calls == 3:
+			if len(list) != 0 || len(savedSchedules(t)) != 0 {
+				t.Fatalf("at %s: schedule kept after it succeeded: %+v", step.at, list)
+			}
+		case step.failures == 0:
+			if len(list) != 1 || list[0].Failures != 0 || list[0].Retry != nil {
+				t.Fatalf("at %s: schedule changed before it ran: %+v", step.at, list)
+			}
+		default:
+			if len(list) != 1 || list[0].Failures != step.failures || list[0].Retry == nil ||
+				!list[0].Retry.Equal(t0.Add(step.retry)) || list[0].Error != unplugged.Error() {
+				t.Fatalf("at %s: schedule %+v, want %d failures and a retry at %s", step.at, list, step.failures, step.retry)
+			}
+			if saved := savedSchedules(t); len(saved) != 1 || saved[0].Failures != step.failures {
+				t.Fatalf("at %s: saved %+v", step.at, saved)
+			}
+		}
+	}
+	if c := (*calls)[0]; c != (scheduledCall{0, 3, false}) {
+		t.Errorf("ran as %+v", c)
+	}
+}
+
+func TestCronScheduleError(t *testing.T) {
+	t0 := time.Date(2026, 3, 14, 7, 0, 0, 0, time.Local)
+	refusedErr := refused("switch 4 is interlocked")
+	calls := startFakeScheduler(t, []portSchedule{{Id: "c", Hub: 0, Port: 4, State: true, Cron: "0 7 * * *"}}, refusedErr)
+
+	// Only at the start of a matching minute
+	runDueSchedules(t0, false)
+	runDueSchedules(t0.Add(-time.Minute), true)
+	if len(*calls) != 0 {
+		t.Fatalf("cron ran %d times outside its minute", len(*calls))
+	}
+
+	runDueSchedules(t0, true)
+	list := currentSchedules()
+	if len(*calls) != 1 || len(list) != 1 || list[0].Error != refusedErr.Error() || list[0].Failures != 0 || list[0].Retry != nil {
+		t.Fatalf("after a failed run: %d runs, %+v", len(*calls), list)
+	}
+
+	runDueSchedules(t0.Add(24*time.Hour), true)
+	list = currentSchedules()
+	if len(*calls) != 2 || len(list) != 1 || list[0].Error != "" {
+		t.Fatalf("after a successful run: %d runs, %+v", len(*calls), list)
+	}
+	if saved := savedSchedules(t); len(saved) != 1 || saved[0].Error != "" {
+		t.Errorf("saved %+v", saved)
+	}
+}
+
+func TestScheduleWaitsForRestore(t *testing.T) {
+	t0 := time.Date(2026, 3, 14, 23, 30, 0, 0, time.Local)
+	calls := startFakeScheduler(t, []portSchedule{{Id: "b", Hub: 1, Port: 2, At: &t0}})
+
+	runDueSchedules(t0.Add(time.Hour), true)
+	if len(*calls) != 0 {
+		t.Fatal("schedule ran before its hub was restored")
+	}
+	schedules.Lock()
+	schedules.ready[1] = true
+	schedules.Unlock()
+	runDueSchedules(t0.Add(time.Hour), true)
+	if len(*calls) != 1 || len(currentSchedules()) != 0 {
+		t.Errorf("after restore: %d runs, %+v", len(*calls), currentSchedules())
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Persistence of the settings and state files. Saves go to a temporary file which is synced and then
+// renamed over the real file, so a crash or a full disk can never leave a half written file.
+// The previous copy of settings.json is kept as settings.json.bak and used if settings.json cannot be read.
+// Configuration lives in settings.json, runtime state such as switch values in state.json.
+// Both files hold a list with one entry per hub.
+
+const settingsFile = "settings.json"
+const stateFile = "state.json"
+const settingsVersion = 9 // Increment when adding a migration
+
+// Layout of settings.json. Files written before version 4 hold a single hub without the list.
+type settingsLayout struct {
+	Hubs []*swconfig `json:"hubs"`
+}
+
+// Layout of state.json. Files written before version 4 hold the state of a single hub without the list.
+type stateLayout struct {
+	Hubs []*swstate `json:"hubs"`
+}
+
+// Unique ids that were shipped as defaults by versions before 3, so every install had the same ids
+var shippedUniqueIDs = []string{
+	"6fd5bae2-40ed-489f-b6f3-a562822e48e9",
+	"86c4b6ea-650d-45cd-ad5d-1771c86edee6",
+	"b96a0f0d-3b3f-4240-a7dc-807645a91a9a",
+	"5cf95480-14ed-49c6-b992-a5eb8c4c9fb2",
+	"9e2090fa-a793-4d4e-9302-3d97ba5566d2",
+	"16eef02f-e1f0-4b94-8a66-a45ca005246f",
+	"8d5641ce-34d4-4750-a0d7-210603a4ea33",
+	"177ed90e-f8f4-46c3-8bd3-b00e4c7dedb5",
+	"c0babc9b-4403-4b8f-9d5a-f53a848f7aa2",
+	"96730903-e921-4a0d-8f45-f76597cf6259",
+	"0c466cbc-a363-40fb-825c-07e33f0c696f",
+	"41ce27ac-de5c-472a-a2a2-c37e3490c627",
+	"5e95431e-6a38-4cd3-8cc0-65dfdb087e82",
+}
+
+// settingsMigrations[n] upgrades settings from version n to version n+1
+var settingsMigrations = []func(s *sw){
+	// 0 -> 1: files written before the version field have no shutdown policy or startup mode
+	func(s *sw) {
+		if s.Shutdownpolicy == "" {
+			s.Shutdownpolicy = ShutdownLeave
+		}
+		if s.Startupmode == "" {
+			s.Startupmode = StartupRestore
+		}
+		if s.Bootsequence == nil {
+			s.Bootsequence = []bootStep{}
+		}
+	},
+	// 1 -> 2: connected, focuser position and switch values moved to state.json.
+	// They are still read from the old settings file and written to state.json by mhpLoadSettings.
+	func(s *sw) {},
+	// 2 -> 3: replace the unique ids every install shipped with by ids generated for this install
+	func(s *sw) {
+		if s.Uniqueid == nil {
+			s.Uniqueid = &[13]string{}
+		}
+		for i, id := range s.Uniqueid {
+			if id == "" || slices.Contains(shippedUniqueIDs, strings.ToLower(id)) {
+				s.Uniqueid[i] = newUniqueID()
+				log.Printf("Generated a new unique id for %s, clients such as N.I.N.A. may need to select the device again", s.Name[i])
+			}
+		}
+	},
+	// 3 -> 4: settings.json lists the hubs, each identified by usbpath or usbserial.
+	// A single hub needs neither, the file is rewritten in the new layout by mhpLoadSettings.
+	func(s *sw) {},
+	// 4 -> 5: each hub is one switch and one focuser device instead of a device per channel.
+	// The focuser keeps the id of channel 0 and the switch that of channel 1, the first switch
+	// channel, so that clients still recognise them. devicetype, number and uniqueid are dropped.
+	func(s *sw) {
+		if s.Uniqueid != nil {
+			s.Focuseruniqueid = s.Uniqueid[0]
+			s.Switchuniqueid = s.Uniqueid[1]
+		}
+		if s.Focuseruniqueid == "" {
+			s.Focuseruniqueid = newUniqueID()
+		}
+		if s.Switchuniqueid == "" {
+			s.Switchuniqueid = newUniqueID()
+		}
+		s.swlegacy = swlegacy{}
+	},
+	// 5 -> 6: automatic dew heater control, every heater starts in manual mode
+	func(s *sw) {
+		for n := range s.Dewheaters {
+			s.Dewheaters[n] = defaultDewHeater()
+		}
+		s.Weather = defaultWeatherSource()
+	},
+	// 6 -> 7: dew heater schedule, the night-time level of each heater and the site for sun times
+	func(s *sw) {
+		for n := range s.Dewheaters {
+			s.Dewheaters[n].Level = defaultDewHeater().Level
+		}
+		s.Dewschedule = defaultDewSchedule()
+	},
+	// 7 -> 8: interlocks between channels, none to start with
+	func(s *sw) {
+		s.Interlocks = []interlock{}
+	},
+	// 8 -> 9: critical channels, none to start with
+	func(s *sw) {
+		s.Critical = [13]bool{}
+		s.Confirmwindow = defaultConfirmWindow
+	},
+}
+
+// Generate a random (version 4) UUID
+func newUniqueID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(err)
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func mhpSaveSettings() error {
+	sm.Lock()
+	defer sm.Unlock()
+
+	data, err := marshalSettings()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(settingsFile, data, true); err != nil {
+		return fmt.Errorf("unable to save settings: %w", err)
+	}
+	recordSettingsStamp()
+	return nil
+}
+
+// Caller must hold sm
+func marshalSettings() ([]byte, error) {
+	var layout settingsLayout
+	for _, h := range hubs {
+		layout.Hubs = append(layout.Hubs, &h.swconfig)
+	}
+	return json.MarshalIndent(&layout, "", "    ")
+}
+
+// Caller must hold sm
+func marshalState() ([]byte, error) {
+	var layout stateLayout
+	for _, h := range hubs {
+		layout.Hubs = append(layout.Hubs, &h.swstate)
+	}
+	return json.MarshalIndent(&layout, "", "    ")
+}
+
+// Save the runtime state. Normally called by the state writer rather than directly.
+func mhpSaveState() error {
+	stateSaveMutex.Lock()
+	defer stateSaveMutex.Unlock()
+
+	sm.Lock()
+	data, err := marshalState()
+	sm.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(stateFile, data, false); err != nil {
+		return fmt.Errorf("unable to save state: %w", err)
+	}
+	return nil
+}
+
+// Load settings.json, falling back to the backup copy if it has been damaged.
+// Returns false if there are no settings yet and the defaults should be used,
+// or an error describing every problem if the settings are not valid.
+func mhpLoadSettings() (bool, error) {
+	sm.Lock()
+	defer sm.Unlock()
+
+	name := settingsFile
+	loaded, legacy, data, err := readSettings(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		name = settingsFile + ".bak"
+		loaded, legacy, data, err = readSettings(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+	}
+	if settingsCorrupt(err) {
+		log.Println("WARNING: unable to read", err)
+		// Keep the damaged file for inspection, the next save would overwrite it
+		corrupt := settingsFile + ".corrupt"
+		if rerr := os.Rename(settingsFile, corrupt); rerr == nil {
+			log.Println("WARNING: damaged settings moved to", corrupt)
+		}
+		name = settingsFile + ".bak"
+		loaded, legacy, data, err = readSettings(name)
+		if err != nil {
+			log.Println("WARNING: no usable backup settings, starting with the defaults:", err)
+			return false, nil
+		}
+		log.Println("WARNING: using the backup copy", name)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	migrated := false
+	for _, h := range loaded {
+		if migrateSettings(h) {
+			migrated = true
+		}
+	}
+	if problems := locateProblems(name, data, validateHubs(loaded, legacy)); problems != nil {
+		return false, problems
+	}
+
+	// State saved by the state writer takes precedence over anything left in an old settings file
+	data, err = os.ReadFile(stateFile)
+	if err == nil {
+		if err := decodeState(data, loaded); err != nil {
+			log.Println("WARNING: unable to read", stateFile, ":", err)
+		}
+	}
+	hubs = loaded
+
+	if errors.Is(err, fs.ErrNotExist) || legacy {
+		data, err := marshalState()
+		if err != nil {
+			return false, err
+		}
+		if err := writeFileAtomic(stateFile, data, false); err != nil {
+			return false, fmt.Errorf("unable to save state: %w", err)
+		}
+	}
+
+	if migrated {
+		data, err := marshalSettings()
+		if err != nil {
+			return false, err
+		}
+		if err := writeFileAtomic(settingsFile, data, true); err != nil {
+			return false, fmt.Errorf("unable to save upgraded settings: %w", err)
+		}
+	}
+	recordSettingsStamp()
+	return true, nil
+}
+
+// Overlay the contents of state.json on the loaded hubs. A hub missing from the file keeps its state.
+func decodeState(data []byte, loaded []*sw) error {
+	var probe struct {
+		Hubs json.RawMessage `json:"hubs"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+	if probe.Hubs == nil {
+		// Written before version 4, the state of a single hub
+		return json.Unmarshal(data, &loaded[0].swstate)
+	}
+	var states []json.RawMessage
+	if err := json.Unmarshal(probe.Hubs, &states); err != nil {
+		return err
+	}
+	for i, state := range states {
+		if i >= len(loaded) {
+			break
+		}
+		if err := json.Unmarshal(state, &loaded[i].swstate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Upgrade settings to the current version. Returns false if they were already current.
+func migrateSettings(s *sw) bool {
+	if s.Version >= settingsVersion {
+		return false
+	}
+	for v := s.Version; v < settingsVersion; v++ {
+		log.Printf("Upgrading settings from version %d to %d", v, v+1)
+		settingsMigrations[v](s)
+		s.Version = v + 1
+	}
+	return true
+}
+
+func readSettings(name string) (loaded []*sw, legacy bool, data []byte, err error) {
+	data, err = os.ReadFile(name)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	loaded, legacy, problems := decodeSettings(name, data)
+	if problems != nil {
+		return nil, legacy, data, problems
+	}
+	return loaded, legacy, data, nil
+}
+
+// Read the settings of a single hub, as held by a profile
+func readHubSettings(name string) (*sw, []byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	loaded, problems := decodeHubSettings(name, data)
+	if problems != nil {
+		return nil, data, problems
+	}
+	return loaded, data, nil
+}
+
+// Replace name with data without ever leaving a partly written file behind.
+// If backup is set the current contents of name are first copied to name.bak.
+func writeFileAtomic(name string, data []byte, backup bool) error {
+	if backup {
+		current, err := os.ReadFile(name)
+		if err == nil {
+			if err := writeFileAtomic(name+".bak", current, false); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(name))
+	return nil
+}
+
+// Make the rename durable. Directories cannot be synced on Windows, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// HTML setup pages shared by the switch and focuser devices
+
+var setupPage = template.Must(template.New("setup").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Hub {{.Hub}}</p>
+{{if .Message}}<p><b>{{.Message}}</b></p>{{end}}
+<h2>Dew schedule</h2>
+{{if .Dew.Heaters}}
+{{if .Dew.HasSun}}<p>Next night: {{.Dew.Night}}</p>{{else}}<p>No sunset or sunrise at this latitude in the next few days, the scheduled heaters are off.</p>{{end}}
+<table>
+<tr><th>Heater</th><th>Night level</th><th>Now</th></tr>
+{{range .Dew.Heaters}}<tr><td>{{.Name}}</td><td>{{.Level}}%</td><td>{{.Now}}%</td></tr>
+{{end}}</table>
+{{else}}
+<p>No dew heaters in schedule mode. Set a heater's mode to <code>schedule</code> in settings.json to turn it on at night.</p>
+{{end}}
+<h2>Profiles</h2>
+<p>Current profile: {{if .Profile}}{{.Profile}}{{else}}none{{end}}</p>
+{{if .Profiles}}
+<table>
+{{range .Profiles}}<tr><td>{{.}}</td><td><form method="post" action="/setup/v1/profile"><input type="hidden" name="Name" value="{{.}}"><input type="hidden" name="Hub" value="{{$.Hub}}"><input type="hidden" name="Return" value="{{$.Return}}"><button type="submit">Use</button></form></td></tr>
+{{end}}</table>
+{{else}}
+<p>No profiles saved. Use <code>mhp profile save &lt;name&gt;</code> to save the current settings as a profile.</p>
+{{end}}
+</body>
+</html>
+`))
+
+type setupPageData struct {
+	Title    string
+	Hub      int
+	Return   string
+	Message  string
+	Profile  string
+	Profiles []string
+	Dew      dewScheduleStatus
+}
+
+func (srv *ApiServer) writeSetupPage(w http.ResponseWriter, r *http.Request, title string, hub int) {
+	profiles, err := MhpListProfiles()
+	data := setupPageData{
+		Title:    title,
+		Hub:      hub,
+		Return:   r.URL.Path,
+		Message:  r.URL.Query().Get("message"),
+		Profile:  MhpGetProfile(hub),
+		Profiles: profiles,
+		Dew:      MhpGetDewSchedule(hub, time.Now()),
+	}
+	if err != nil {
+		data.Message = err.Error()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := setupPage.Execute(w, data); err != nil {
+		log.Println("Setup page:", err)
+	}
+}
+
+// Switches to the profile posted from a setup page and returns to that page
+func (srv *ApiServer) handleUseProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	name := r.PostFormValue("Name")
+	hub, err := strconv.Atoi(r.PostFormValue("Hub"))
+	if err != nil || checkHub(hub) != nil {
+		http.Error(w, "invalid hub", http.StatusBadRequest)
+		return
+	}
+	back := r.PostFormValue("Return")
+	if back != fmt.Sprintf("/setup/v1/switch/%d/setup", hub) && back != fmt.Sprintf("/setup/v1/focuser/%d/setup", hub) {
+		back = fmt.Sprintf("/setup/v1/switch/%d/setup", hub)
+	}
+	message := "Now using profile " + name
+	if err := MhpUseProfile(hub, name); err != nil {
+		message = err.Error()
+	}
+	http.Redirect(w, r, back+"?message="+template.URLQueryEscaper(message), http.StatusSeeOther)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Background writer for the runtime state. Changes are coalesced so that a burst of requests,
+// such as dragging a dew heater slider in N.I.N.A., results in a single write to state.json.
+
+const stateWriteDelay = 2 * time.Second
+
+var stateSaveMutex sync.Mutex
+
+var stateWriter struct {
+	sync.Mutex
+	running bool
+	changed chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Record that the runtime state has changed. Without a running state writer,
+// e.g. when using the command line, the state is saved straight away.
+func stateChanged() {
+	stateWriter.Lock()
+	running := stateWriter.running
+	changed := stateWriter.changed
+	stateWriter.Unlock()
+
+	if !running {
+		if err := mhpSaveState(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	select {
+	case changed <- struct{}{}:
+	default:
+		// A save is already pending
+	}
+}
+
+// Start saving state changes in the background
+func MhpStartStateWriter() {
+	stateWriter.Lock()
+	defer stateWriter.Unlock()
+	if stateWriter.running {
+		return
+	}
+	stateWriter.running = true
+	stateWriter.changed = make(chan struct{}, 1)
+	stateWriter.stop = make(chan struct{})
+	stateWriter.done = make(chan struct{})
+	go runStateWriter(stateWriter.changed, stateWriter.stop, stateWriter.done)
+}
+
+// Stop the background writer, saving any pending changes first
+func MhpStopStateWriter() {
+	stateWriter.Lock()
+	if !stateWriter.running {
+		stateWriter.Unlock()
+		return
+	}
+	stateWriter.running = false
+	close(stateWriter.stop)
+	done := stateWriter.done
+	stateWriter.Unlock()
+	<-done
+}
+
+func runStateWriter(changed chan struct{}, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-changed:
+		case <-stop:
+			flushState(changed)
+			return
+		}
+		// Let further changes accumulate before writing
+		select {
+		case <-time.After(stateWriteDelay):
+		case <-stop:
+		}
+		if err := mhpSaveState(); err != nil {
+			log.Println(err)
+		}
+		select {
+		case <-stop:
+			flushState(changed)
+			return
+		default:
+		}
+	}
+}
+
+// Save a change that arrived after the last write
+func flushState(changed chan struct{}) {
+	select {
+	case <-changed:
+		if err := mhpSaveState(); err != nil {
+			log.Println(err)
+		}
+	default:
+	}
+}
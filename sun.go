@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Sunrise and sunset worked out locally with the NOAA approximate solar position equations,
+// accurate to a minute or two, which is plenty for switching dew heaters.
+
+// Sunrise and sunset in UTC for the given calendar day at latitude and longitude (degrees, east positive).
+// ok is false if the sun does not rise or set that day, as happens near the poles.
+func sunTimes(day time.Time, latitude float64, longitude float64) (sunrise time.Time, sunset time.Time, ok bool) {
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+
+	// Fractional year in radians at noon UTC of the day, where the hour term of the NOAA formula,
+	// (hour - 12) / 24, is zero. Only the day of the year is taken from midnight.
+	gamma := 2 * math.Pi / daysInYear(day.Year()) * float64(midnight.YearDay()-1)
+	eqtime := 229.18 * (0.000075 + 0.001868*math.Cos(gamma) - 0.032077*math.Sin(gamma) -
+		0.014615*math.Cos(2*gamma) - 0.040849*math.Sin(2*gamma)) // minutes
+	decl := 0.006918 - 0.399912*math.Cos(gamma) + 0.070257*math.Sin(gamma) -
+		0.006758*math.Cos(2*gamma) + 0.000907*math.Sin(2*gamma) -
+		0.002697*math.Cos(3*gamma) + 0.00148*math.Sin(3*gamma) // radians
+
+	// Hour angle of the sun at rise and set, allowing for refraction and the size of the disc
+	lat := latitude * math.Pi / 180
+	cosHA := math.Cos(90.833*math.Pi/180)/(math.Cos(lat)*math.Cos(decl)) - math.Tan(lat)*math.Tan(decl)
+	if cosHA < -1 || cosHA > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	ha := math.Acos(cosHA) * 180 / math.Pi
+
+	minutes := func(m float64) time.Time {
+		return midnight.Add(time.Duration(m * float64(time.Minute)))
+	}
+	sunrise = minutes(720 - 4*(longitude+ha) - eqtime)
+	sunset = minutes(720 - 4*(longitude-ha) - eqtime)
+	return sunrise, sunset, true
+}
+
+func daysInYear(year int) float64 {
+	return float64(time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC).YearDay())
+}
@@ -1,39 +1,42 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 func (srv *ApiServer) configureSwitchAPI(router *httprouter.Router) {
 	// ASCOM Methods specifc to the Switch API
-	router.GET("/setup/v1/switch/1/setup", srv.handleSwitchSetup)
-	router.GET("/api/v1/switch/1/maxswitch", srv.handleMaxSwitch)
-	router.GET("/api/v1/switch/1/canwrite", srv.handleCanWrite)
-	router.GET("/api/v1/switch/1/getswitch", srv.handleGetSwitch)
-	router.GET("/api/v1/switch/1/getswitchdescription", srv.handleGetSwitchDescription)
-	router.GET("/api/v1/switch/1/getswitchname", srv.handleGetSwitchName)
-	router.GET("/api/v1/switch/1/getswitchvalue", srv.handleGetSwitchValue)
-	router.GET("/api/v1/switch/1/minswitchvalue", srv.handleMinSwitchValue)
-	router.GET("/api/v1/switch/1/maxswitchvalue", srv.handleMaxSwitchValue)
-	router.PUT("/api/v1/switch/1/setswitch", srv.handleSetSwitch)
-	router.PUT("/api/v1/switch/1/setswitchname", srv.handleSetSwitchName)
-	router.PUT("/api/v1/switch/1/setswitchvalue", srv.handleSetSwitchValue)
-	router.GET("/api/v1/switch/1/switchstep", srv.handleSwitchStep)
+	router.GET("/setup/v1/switch/:device_number/setup", srv.device(DeviceTypeSwitch, srv.handleSwitchSetup))
+	router.GET("/api/v1/switch/:device_number/maxswitch", srv.device(DeviceTypeSwitch, srv.handleMaxSwitch))
+	router.GET("/api/v1/switch/:device_number/canwrite", srv.device(DeviceTypeSwitch, srv.handleCanWrite))
+	router.GET("/api/v1/switch/:device_number/getswitch", srv.device(DeviceTypeSwitch, srv.handleGetSwitch))
+	router.GET("/api/v1/switch/:device_number/getswitchdescription", srv.device(DeviceTypeSwitch, srv.handleGetSwitchDescription))
+	router.GET("/api/v1/switch/:device_number/getswitchname", srv.device(DeviceTypeSwitch, srv.handleGetSwitchName))
+	router.GET("/api/v1/switch/:device_number/getswitchvalue", srv.device(DeviceTypeSwitch, srv.handleGetSwitchValue))
+	router.GET("/api/v1/switch/:device_number/minswitchvalue", srv.device(DeviceTypeSwitch, srv.handleMinSwitchValue))
+	router.GET("/api/v1/switch/:device_number/maxswitchvalue", srv.device(DeviceTypeSwitch, srv.handleMaxSwitchValue))
+	router.PUT("/api/v1/switch/:device_number/setswitch", srv.device(DeviceTypeSwitch, srv.handleSetSwitch))
+	router.PUT("/api/v1/switch/:device_number/setswitchname", srv.device(DeviceTypeSwitch, srv.handleSetSwitchName))
+	router.PUT("/api/v1/switch/:device_number/setswitchvalue", srv.device(DeviceTypeSwitch, srv.handleSetSwitchValue))
+	router.GET("/api/v1/switch/:device_number/switchstep", srv.device(DeviceTypeSwitch, srv.handleSwitchStep))
 }
 
 // Handlers below are specific for the Switch API
 
 // Setup page.
-func (srv *ApiServer) handleSwitchSetup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	fmt.Fprintln(w, "Alpaca MHP switch server")
+func (srv *ApiServer) handleSwitchSetup(w http.ResponseWriter, r *http.Request, hub int) {
+	srv.writeSetupPage(w, r, "Alpaca MHP switch server", hub)
 }
 
 // Returns the number of switch devices managed by this driver. Devices are numbered from 0 to MaxSwitch - 1
-func (srv *ApiServer) handleMaxSwitch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleMaxSwitch(w http.ResponseWriter, r *http.Request, hub int) {
 	resp := int32Response{
 		Value: NumOnOffSwitch + NumVarSwitch,
 	}
@@ -43,12 +46,27 @@ func (srv *ApiServer) handleMaxSwitch(w http.ResponseWriter, r *http.Request, _
 	json.NewEncoder(w).Encode(resp)
 }
 
-// Reports if the specified switch device can be written to, default true.
+// Reports if the specified switch device can be written to, from canwrite in settings.json.
 // This is false if the device cannot be written to, for example a limit switch or a sensor.
 // Devices are numbered from 0 to MaxSwitch - 1
-func (srv *ApiServer) handleCanWrite(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleCanWrite(w http.ResponseWriter, r *http.Request, hub int) {
+	var canWrite bool
+	sn, err := getIdFromRequest(r)
+	if err == nil {
+		canWrite, err = MhpGetCanWrite(hub, sn)
+	}
+	if err != nil {
+		resp := stringResponse{
+			Value: err.Error(),
+		}
+		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
 	resp := booleanResponse{
-		Value: true, // all switches can be changed
+		Value: canWrite,
 	}
 	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
 	w.Header().Set("Content-Type", "application/json")
@@ -57,7 +75,7 @@ func (srv *ApiServer) handleCanWrite(w http.ResponseWriter, r *http.Request, _ h
 }
 
 // Return the state of switch device id as a boolean. Devices are numbered from 0 to MaxSwitch - 1
-func (srv *ApiServer) handleGetSwitch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleGetSwitch(w http.ResponseWriter, r *http.Request, hub int) {
 	// Get the switch number from the the request
 	sn, err := getIdFromRequest(r)
 	if err != nil {
@@ -69,7 +87,7 @@ func (srv *ApiServer) handleGetSwitch(w http.ResponseWriter, r *http.Request, _
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(resp)
 	} else {
-		result, err := MhpGetOnOff(sn)
+		result, err := MhpGetOnOff(hub, sn)
 		if err != nil {
 			resp := stringResponse{
 				Value: err.Error(),
@@ -93,7 +111,7 @@ func (srv *ApiServer) handleGetSwitch(w http.ResponseWriter, r *http.Request, _
 // Gets the description of the specified switch device.
 // This is to allow a fuller description of the device to be returned,
 // for example for a tool tip. Devices are numbered from 0 to MaxSwitch - 1
-func (srv *ApiServer) handleGetSwitchDescription(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleGetSwitchDescription(w http.ResponseWriter, r *http.Request, hub int) {
 	// Get the switch number from the the request
 	sn, err := getIdFromRequest(r)
 	if err != nil {
@@ -106,7 +124,7 @@ func (srv *ApiServer) handleGetSwitchDescription(w http.ResponseWriter, r *http.
 		json.NewEncoder(w).Encode(resp)
 
 	} else {
-		result := MhpGetName(sn)
+		result := MhpGetName(hub, sn)
 		resp := stringResponse{
 			Value: result,
 		}
@@ -118,7 +136,7 @@ func (srv *ApiServer) handleGetSwitchDescription(w http.ResponseWriter, r *http.
 }
 
 // Gets the name of the specified switch device. Devices are numbered from 0 to MaxSwitch - 1
-func (srv *ApiServer) handleGetSwitchName(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleGetSwitchName(w http.ResponseWriter, r *http.Request, hub int) {
 	// Get the switch number from the the request
 	sn, err := getIdFromRequest(r)
 	if err != nil {
@@ -130,7 +148,7 @@ func (srv *ApiServer) handleGetSwitchName(w http.ResponseWriter, r *http.Request
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(resp)
 	} else {
-		result := MhpGetName(sn)
+		result := MhpGetName(hub, sn)
 		resp := stringResponse{
 			Value: result,
 		}
@@ -144,7 +162,7 @@ func (srv *ApiServer) handleGetSwitchName(w http.ResponseWriter, r *http.Request
 // Gets the value of the specified switch device as a double.
 // Devices are numbered from 0 to MaxSwitch - 1,
 // The value of this switch is expected to be between MinSwitchValue and MaxSwitchValue.
-func (srv *ApiServer) handleGetSwitchValue(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleGetSwitchValue(w http.ResponseWriter, r *http.Request, hub int) {
 	// Get the switch number from the the request
 	sn, err := getIdFromRequest(r)
 	if err != nil {
@@ -156,7 +174,7 @@ func (srv *ApiServer) handleGetSwitchValue(w http.ResponseWriter, r *http.Reques
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(resp)
 	} else {
-		result := MhpGetValue(sn)
+		result := MhpGetValue(hub, sn)
 		resp := doubleResponse{
 			Value: result,
 		}
@@ -169,7 +187,7 @@ func (srv *ApiServer) handleGetSwitchValue(w http.ResponseWriter, r *http.Reques
 }
 
 // Gets the minimum value of the specified switch device as a double. Devices are numbered from 0 to MaxSwitch - 1.
-func (srv *ApiServer) handleMinSwitchValue(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleMinSwitchValue(w http.ResponseWriter, r *http.Request, hub int) {
 	// Get the switch number from the the request
 	sn, err := getIdFromRequest(r)
 	if err != nil {
@@ -182,7 +200,7 @@ func (srv *ApiServer) handleMinSwitchValue(w http.ResponseWriter, r *http.Reques
 		json.NewEncoder(w).Encode(resp)
 		return
 	} else {
-		result := MhpGetMin(sn)
+		result := MhpGetMin(hub, sn)
 		resp := doubleResponse{
 			Value: result,
 		}
@@ -195,7 +213,7 @@ func (srv *ApiServer) handleMinSwitchValue(w http.ResponseWriter, r *http.Reques
 }
 
 // Gets the maximum value of the specified switch device as a double. Devices are numbered from 0 to MaxSwitch - 1.
-func (srv *ApiServer) handleMaxSwitchValue(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleMaxSwitchValue(w http.ResponseWriter, r *http.Request, hub int) {
 	// Get the switch number from the the request
 	sn, err := getIdFromRequest(r)
 	if err != nil {
@@ -208,7 +226,7 @@ func (srv *ApiServer) handleMaxSwitchValue(w http.ResponseWriter, r *http.Reques
 		json.NewEncoder(w).Encode(resp)
 		return
 	} else {
-		result := MhpGetMax(sn)
+		result := MhpGetMax(hub, sn)
 		resp := doubleResponse{
 			Value: result,
 		}
@@ -221,7 +239,7 @@ func (srv *ApiServer) handleMaxSwitchValue(w http.ResponseWriter, r *http.Reques
 }
 
 // Sets a switch controller device to the specified state, true or false.
-func (srv *ApiServer) handleSetSwitch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleSetSwitch(w http.ResponseWriter, r *http.Request, hub int) {
 	// Note this is a PUT
 	// Get the switch number from the the request
 	sn, err := getIdFromRequest(r)
@@ -246,8 +264,17 @@ func (srv *ApiServer) handleSetSwitch(w http.ResponseWriter, r *http.Request, _
 			json.NewEncoder(w).Encode(resp)
 			return
 		} else {
-			err := MhpSetOnOff(sn, sv)
-			if err != nil {
+			err := MhpSetOnOff(hub, sn, sv, alpacaOrigin(r))
+			if isRefused(err) {
+				resp := putResponse{}
+				resp.ErrorNumber = errInvalidOperation
+				resp.ErrorMessage = err.Error()
+				srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(resp)
+				return
+			} else if err != nil {
 				resp := stringResponse{
 					Value: err.Error(),
 				}
@@ -271,7 +298,7 @@ func (srv *ApiServer) handleSetSwitch(w http.ResponseWriter, r *http.Request, _
 }
 
 // Sets a switch device name to the specified value.
-func (srv *ApiServer) handleSetSwitchName(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleSetSwitchName(w http.ResponseWriter, r *http.Request, hub int) {
 	// Note this is a PUT
 	sn, err := getIdFromRequest(r)
 	if err != nil {
@@ -296,7 +323,7 @@ func (srv *ApiServer) handleSetSwitchName(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = MhpSetName(sn, sna)
+	err = MhpSetName(hub, sn, sna)
 	if err != nil {
 		resp := stringResponse{
 			Value: err.Error(),
@@ -317,7 +344,7 @@ func (srv *ApiServer) handleSetSwitchName(w http.ResponseWriter, r *http.Request
 }
 
 // Sets a switch device value to the specified value.
-func (srv *ApiServer) handleSetSwitchValue(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleSetSwitchValue(w http.ResponseWriter, r *http.Request, hub int) {
 	// Note this is a PUT
 	sn, err := getIdFromRequest(r)
 	if err != nil {
@@ -341,7 +368,17 @@ func (srv *ApiServer) handleSetSwitchValue(w http.ResponseWriter, r *http.Reques
 		json.NewEncoder(w).Encode(resp)
 		return
 	}
-	err = MhpSetValue(sn, sv)
+	err = MhpSetValue(hub, sn, sv, alpacaOrigin(r))
+	if isRefused(err) {
+		resp := putResponse{}
+		resp.ErrorNumber = errInvalidOperation
+		resp.ErrorMessage = err.Error()
+		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
 	if err != nil {
 		resp := stringResponse{
 			Value: err.Error(),
@@ -361,7 +398,7 @@ func (srv *ApiServer) handleSetSwitchValue(w http.ResponseWriter, r *http.Reques
 
 // Returns the step size that this device supports (the difference between successive values of the device).
 // Devices are numbered from 0 to MaxSwitch - 1.
-func (srv *ApiServer) handleSwitchStep(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (srv *ApiServer) handleSwitchStep(w http.ResponseWriter, r *http.Request, hub int) {
 
 	sn, err := getIdFromRequest(r)
 	if err != nil {
@@ -374,7 +411,7 @@ func (srv *ApiServer) handleSwitchStep(w http.ResponseWriter, r *http.Request, _
 		json.NewEncoder(w).Encode(resp)
 		return
 	}
-	result := MhpGetStep(sn) // should always be 1
+	result := MhpGetStep(hub, sn) // should always be 1
 
 	resp := doubleResponse{
 		Value: result,
@@ -384,3 +421,119 @@ func (srv *ApiServer) handleSwitchStep(w http.ResponseWriter, r *http.Request, _
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
 }
+
+// Actions supported by the switch device
+const (
+	actionBootSequence   = "BootSequence"
+	actionSetSwitchAfter = "SetSwitchAfter"
+	actionSetSwitchCron  = "SetSwitchCron"
+	actionListSchedules  = "ListSchedules"
+	actionCancelSchedule = "CancelSchedule"
+	actionRequestOff     = "RequestSwitchOff"
+	actionConfirmOff     = "ConfirmSwitchOff"
+)
+
+// Returns the list of action names supported by the switch device.
+func (srv *ApiServer) handleSwitchSupportedActions(w http.ResponseWriter, r *http.Request, hub int) {
+	resp := stringlistResponse{
+		Value: []string{actionBootSequence, actionSetSwitchAfter, actionSetSwitchCron, actionListSchedules, actionCancelSchedule, actionRequestOff, actionConfirmOff},
+	}
+	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Invokes the specified device-specific custom action.
+// BootSequence starts the configured boot sequence and returns straight away.
+// SetSwitchAfter ("<id> <on|off> <delay>") and SetSwitchCron ("<id> <on|off> <cron>") add a
+// schedule for a power port and return its id, which CancelSchedule takes to remove it.
+// ListSchedules returns the schedules of the hub as JSON.
+// RequestSwitchOff ("<id>") returns a token that ConfirmSwitchOff ("<id> <token>") takes to
+// turn off a critical power port, see critical.go.
+func (srv *ApiServer) handleSwitchAction(w http.ResponseWriter, r *http.Request, hub int) {
+	action, parameters, err := getActionFromRequest(r)
+	if err != nil {
+		resp := stringResponse{
+			Value: err.Error(),
+		}
+		srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	resp := stringResponse{}
+	switch {
+	case strings.EqualFold(action, actionBootSequence):
+		if err := MhpStartBootSequence(context.Background(), hub); err != nil {
+			resp.ErrorNumber = errInvalidOperation
+			resp.ErrorMessage = err.Error()
+		} else {
+			resp.Value = "Boot sequence started"
+		}
+	case strings.EqualFold(action, actionSetSwitchAfter), strings.EqualFold(action, actionSetSwitchCron):
+		parse := parseSetSwitchAfter
+		if strings.EqualFold(action, actionSetSwitchCron) {
+			parse = parseSetSwitchCron
+		}
+		ps, err := parse(hub, parameters)
+		if err == nil {
+			ps, err = MhpAddSchedule(ps)
+		}
+		if err != nil {
+			resp.ErrorNumber = errInvalidValue
+			resp.ErrorMessage = err.Error()
+		} else {
+			resp.Value = ps.Id
+		}
+	case strings.EqualFold(action, actionListSchedules):
+		list := MhpListSchedules(hub)
+		if list == nil {
+			list = []portSchedule{}
+		}
+		data, _ := json.Marshal(list)
+		resp.Value = string(data)
+	case strings.EqualFold(action, actionCancelSchedule):
+		if err := MhpCancelSchedule(hub, strings.TrimSpace(parameters)); err != nil {
+			resp.ErrorNumber = errInvalidValue
+			resp.ErrorMessage = err.Error()
+		} else {
+			resp.Value = "Schedule cancelled"
+		}
+	case strings.EqualFold(action, actionRequestOff):
+		id, err := parseSwitchId(parameters)
+		if err != nil {
+			resp.ErrorNumber = errInvalidValue
+			resp.ErrorMessage = err.Error()
+		} else if resp.Value, err = MhpRequestSwitchOff(hub, id, alpacaOrigin(r)); err != nil {
+			resp.ErrorNumber = errInvalidOperation
+			resp.ErrorMessage = err.Error()
+		}
+	case strings.EqualFold(action, actionConfirmOff):
+		o := alpacaOrigin(r)
+		id, token, _ := strings.Cut(strings.TrimSpace(parameters), " ")
+		o.Token = strings.TrimSpace(token)
+		sn, err := parseSwitchId(id)
+		if err == nil && o.Token == "" {
+			err = errors.New(`parameters must be "<id> <token>"`)
+		}
+		if err != nil {
+			resp.ErrorNumber = errInvalidValue
+			resp.ErrorMessage = err.Error()
+		} else if err = MhpSetOnOff(hub, sn, false, o); err != nil {
+			resp.ErrorNumber = errInvalidOperation
+			resp.ErrorMessage = err.Error()
+		} else {
+			resp.Value = MhpGetName(hub, sn) + " turned off"
+		}
+	default:
+		resp.ErrorNumber = errActionNotImplemented
+		resp.ErrorMessage = fmt.Sprintf("action %s is not supported", action)
+	}
+	srv.prepareAlpacaResponse(r, &resp.alpacaResponse)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -1,5 +1,12 @@
 package main
 
+// Alpaca error numbers
+const (
+	errInvalidValue         = 0x401
+	errInvalidOperation     = 0x40B
+	errActionNotImplemented = 0x40C
+)
+
 type alpacaResponse struct {
 	ClientTransactionID uint32 `json:"ClientTransactionID"`
 	ServerTransactionID uint32 `json:"ServerTransactionID"`
@@ -22,10 +29,10 @@ type booleanResponse struct {
 	alpacaResponse
 }
 
-// type float64Response struct {
-// 	Value float64 `json:"Value"`
-// 	alpacaResponse
-// }
+type float64Response struct {
+	Value float64 `json:"Value"`
+	alpacaResponse
+}
 
 type int32Response struct {
 	Value int32 `json:"Value"`
@@ -57,6 +64,11 @@ type managementDevicesListResponse struct {
 	alpacaResponse
 }
 
+type connectedClientsResponse struct {
+	Value []ConnectedClient `json:"Value"`
+	alpacaResponse
+}
+
 type DeviceConfiguration struct {
 	DeviceName   string `json:"DeviceName"`
 	DeviceType   string `json:"DeviceType"`
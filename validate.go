@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Validation of settings.json. Problems are reported against the json field names
+// and, where it can be found, the line of the file the field is on.
+
+type settingsProblem struct {
+	File    string
+	Line    int // 0 if unknown
+	Column  int // 0 if unknown
+	Field   string
+	Message string
+	corrupt bool
+}
+
+func (p settingsProblem) Error() string {
+	var b strings.Builder
+	b.WriteString(p.File)
+	if p.Line > 0 {
+		fmt.Fprintf(&b, ":%d", p.Line)
+		if p.Column > 0 {
+			fmt.Fprintf(&b, ":%d", p.Column)
+		}
+	}
+	b.WriteString(": ")
+	if p.Field != "" {
+		b.WriteString(p.Field + ": ")
+	}
+	b.WriteString(p.Message)
+	return b.String()
+}
+
+// All the problems found in a settings file
+type settingsProblems []settingsProblem
+
+func (ps settingsProblems) Error() string {
+	var lines []string
+	for _, p := range ps {
+		lines = append(lines, p.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+var arrayIndexes = regexp.MustCompile(`\.(\d+)`)
+var unknownField = regexp.MustCompile(`^unknown field "(.*)"$`)
+
+// Decode the contents of settings.json. Files written before version 4 hold a single hub
+// without the hubs list, these are reported as legacy.
+func decodeSettings(name string, data []byte) (loaded []*sw, legacy bool, problems settingsProblems) {
+	var probe struct {
+		Hubs json.RawMessage `json:"hubs"`
+	}
+	if json.Unmarshal(data, &probe) != nil || probe.Hubs == nil {
+		h, problems := decodeHubSettings(name, data)
+		if problems != nil {
+			return nil, true, problems
+		}
+		return []*sw{h}, true, nil
+	}
+
+	var layout struct {
+		Hubs []*sw `json:"hubs"`
+	}
+	if p, ok := decodeStrict(name, data, &layout); !ok {
+		return nil, false, settingsProblems{p}
+	}
+	for i, h := range layout.Hubs {
+		if h == nil {
+			return nil, false, settingsProblems{{File: name, Field: fmt.Sprintf("hubs[%d]", i), Message: "must not be null"}}
+		}
+		if p, ok := checkVersion(name, h); !ok {
+			p.Field = fmt.Sprintf("hubs[%d].%s", i, p.Field)
+			return nil, false, settingsProblems{p}
+		}
+	}
+	return layout.Hubs, false, nil
+}
+
+// Decode the settings of a single hub, as held by a profile or a settings file from before version 4
+func decodeHubSettings(name string, data []byte) (*sw, settingsProblems) {
+	loaded := &sw{}
+	if p, ok := decodeStrict(name, data, loaded); !ok {
+		return nil, settingsProblems{p}
+	}
+	if p, ok := checkVersion(name, loaded); !ok {
+		return nil, settingsProblems{p}
+	}
+	return loaded, nil
+}
+
+// Decode data into v, rejecting anything that is not valid json or does not match
+// the settings fields. A file damaged by a crash is reported as corrupt.
+func decodeStrict(name string, data []byte, v any) (settingsProblem, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return settingsProblem{}, true
+	}
+	p := settingsProblem{File: name, Message: err.Error()}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		p.Line, p.Column = lineColumn(data, syntaxErr.Offset)
+		p.Message = syntaxErr.Error()
+		p.corrupt = true
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		p.Line, p.Column = lineColumn(data, int64(len(data)))
+		p.Message = "file is empty or truncated"
+		p.corrupt = true
+	case errors.As(err, &typeErr):
+		p.Line, p.Column = lineColumn(data, typeErr.Offset)
+		p.Field = arrayIndexes.ReplaceAllString(typeErr.Field, "[$1]")
+		p.Message = fmt.Sprintf("cannot use a %s as %s", typeErr.Value, typeErr.Type)
+	default:
+		p.Line, p.Column = lineColumn(data, dec.InputOffset())
+		p.Message = strings.TrimPrefix(err.Error(), "json: ")
+		// Point at the misspelt field rather than the end of the file
+		if m := unknownField.FindStringSubmatch(p.Message); m != nil {
+			if offset, ok := jsonFieldOffsets(data)[strings.ToLower(m[1])]; ok {
+				p.Line, p.Column = lineColumn(data, offset)
+			}
+		}
+	}
+	return p, false
+}
+
+func checkVersion(name string, h *sw) (settingsProblem, bool) {
+	if h.Version > settingsVersion {
+		return settingsProblem{
+			File:    name,
+			Field:   "version",
+			Message: fmt.Sprintf("version %d is newer than this driver understands (%d)", h.Version, settingsVersion),
+		}, false
+	}
+	return settingsProblem{}, true
+}
+
+// Decode, migrate and validate a settings file, as done by mhp config check
+func checkSettings(name string, data []byte) settingsProblems {
+	loaded, legacy, problems := decodeSettings(name, data)
+	if problems != nil {
+		return problems
+	}
+	for _, h := range loaded {
+		migrateSettings(h)
+	}
+	return locateProblems(name, data, validateHubs(loaded, legacy))
+}
+
+// Validate every hub and the settings that must differ between hubs.
+// Fields are prefixed with their place in the hubs list unless the file is a legacy single hub.
+func validateHubs(loaded []*sw, legacy bool) (problems settingsProblems) {
+	prefix := func(i int) string {
+		if legacy {
+			return ""
+		}
+		return fmt.Sprintf("hubs[%d].", i)
+	}
+	if len(loaded) == 0 {
+		return settingsProblems{{Field: "hubs", Message: "must list at least one hub"}}
+	}
+
+	paths := make(map[string]int)
+	serials := make(map[string]int)
+	ids := make(map[string]string)
+	for i, h := range loaded {
+		for _, p := range h.swconfig.validate() {
+			p.Field = prefix(i) + p.Field
+			problems = append(problems, p)
+		}
+		if len(loaded) > 1 {
+			if h.Usbpath == "" && h.Usbserial == "" {
+				problems = append(problems, settingsProblem{Field: prefix(i) + "usbserial", Message: "usbserial or usbpath is needed to tell the hubs apart"})
+			}
+			if j, dup := serials[h.Usbserial]; dup && h.Usbserial != "" {
+				problems = append(problems, settingsProblem{Field: prefix(i) + "usbserial", Message: fmt.Sprintf("duplicates hubs[%d].usbserial %q", j, h.Usbserial)})
+			} else {
+				serials[h.Usbserial] = i
+			}
+			if j, dup := paths[h.Usbpath]; dup && h.Usbpath != "" {
+				problems = append(problems, settingsProblem{Field: prefix(i) + "usbpath", Message: fmt.Sprintf("duplicates hubs[%d].usbpath %q", j, h.Usbpath)})
+			} else {
+				paths[h.Usbpath] = i
+			}
+		}
+		for _, u := range []struct{ field, id string }{{"switchuniqueid", h.Switchuniqueid}, {"focuseruniqueid", h.Focuseruniqueid}} {
+			field := prefix(i) + u.field
+			key := strings.ToLower(u.id)
+			if other, dup := ids[key]; dup && u.id != "" && !strings.HasPrefix(other, prefix(i)) {
+				problems = append(problems, settingsProblem{Field: field, Message: fmt.Sprintf("duplicates %s %q", other, u.id)})
+				continue
+			}
+			if _, dup := ids[key]; !dup {
+				ids[key] = field
+			}
+		}
+	}
+	return problems
+}
+
+// Fill in the file name and line of each problem
+func locateProblems(name string, data []byte, problems settingsProblems) settingsProblems {
+	if len(problems) == 0 {
+		return nil
+	}
+	offsets := jsonFieldOffsets(data)
+	for i := range problems {
+		problems[i].File = name
+		if offset, ok := offsets[problems[i].Field]; ok {
+			problems[i].Line, _ = lineColumn(data, offset)
+		}
+	}
+	return problems
+}
+
+// Report whether err is a file that was damaged rather than one with mistakes in it
+func settingsCorrupt(err error) bool {
+	var problems settingsProblems
+	return errors.As(err, &problems) && len(problems) == 1 && problems[0].corrupt
+}
+
+// Check the configuration for values that would load but misbehave later
+func (c *swconfig) validate() (problems settingsProblems) {
+	add := func(field string, format string, args ...any) {
+		problems = append(problems, settingsProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Focusermaxstep < 1 {
+		add("focucermaxstep", "must be at least 1, found %d", c.Focusermaxstep)
+	}
+	if c.Focusermaxincrement < 1 || c.Focusermaxincrement > c.Focusermaxstep {
+		add("focucermaxincrement", "must be between 1 and focucermaxstep (%d), found %d", c.Focusermaxstep, c.Focusermaxincrement)
+	}
+	if c.Focucerspeed < 0 || c.Focucerspeed > 100 {
+		add("focucerspeed", "must be between 0 and 100, found %d", c.Focucerspeed)
+	}
+	switch c.Shutdownpolicy {
+	case ShutdownLeave, ShutdownDewOff, ShutdownAllOff:
+	default:
+		add("shutdownpolicy", "must be one of %s, %s or %s, found %q", ShutdownLeave, ShutdownDewOff, ShutdownAllOff, c.Shutdownpolicy)
+	}
+	switch c.Startupmode {
+	case StartupRestore, StartupAllOff, StartupDefault, StartupNone:
+	default:
+		add("startupmode", "must be one of %s, %s, %s or %s, found %q", StartupRestore, StartupAllOff, StartupDefault, StartupNone, c.Startupmode)
+	}
+
+	if c.Switchuniqueid == "" {
+		add("switchuniqueid", "must not be empty")
+	}
+	if c.Focuseruniqueid == "" {
+		add("focuseruniqueid", "must not be empty")
+	} else if strings.EqualFold(c.Focuseruniqueid, c.Switchuniqueid) {
+		add("focuseruniqueid", "duplicates switchuniqueid %q", c.Focuseruniqueid)
+	}
+
+	for i := range c.Name {
+		if c.Name[i] == "" {
+			add(fmt.Sprintf("name[%d]", i), "must not be empty")
+		}
+	}
+
+	for id := 1; id <= NumSwitches; id++ {
+		name := c.Name[id]
+		if id <= NumOnOffSwitch {
+			if c.Min[id] != 0 {
+				add(fmt.Sprintf("min[%d]", id), "must be 0 for on/off switch %q, found %d", name, c.Min[id])
+			}
+			if c.Max[id] != 1 {
+				add(fmt.Sprintf("max[%d]", id), "must be 1 for on/off switch %q, found %d", name, c.Max[id])
+			}
+			if c.Step[id] != 1 {
+				add(fmt.Sprintf("step[%d]", id), "must be 1 for on/off switch %q, found %d", name, c.Step[id])
+			}
+		} else {
+			if c.Max[id] < 1 || c.Max[id] > 100 {
+				add(fmt.Sprintf("max[%d]", id), "must be between 1 and 100 for dew heater %q, found %d", name, c.Max[id])
+			} else if c.Min[id] < 0 || c.Min[id] >= c.Max[id] {
+				add(fmt.Sprintf("min[%d]", id), "must be at least 0 and less than max for dew heater %q, found %d", name, c.Min[id])
+			}
+			if c.Step[id] < 1 {
+				add(fmt.Sprintf("step[%d]", id), "must be at least 1 for dew heater %q, found %d", name, c.Step[id])
+			}
+		}
+		if c.Default[id] < c.Min[id] || c.Default[id] > c.Max[id] {
+			add(fmt.Sprintf("default[%d]", id), "must be between min (%d) and max (%d) for %q, found %d", c.Min[id], c.Max[id], name, c.Default[id])
+		}
+	}
+
+	automatic, scheduled := false, false
+	for n, d := range c.Dewheaters {
+		field := fmt.Sprintf("dewheaters[%d]", n)
+		switch d.Mode {
+		case DewManual:
+		case DewAuto:
+			automatic = true
+		case DewSchedule:
+			scheduled = true
+			id := NumOnOffSwitch + 1 + n
+			if d.Level < 0 || d.Level > c.Max[id] {
+				add(field+".level", "must be between 0 and %d for %q, found %d", c.Max[id], c.Name[id], d.Level)
+			}
+		default:
+			add(field+".mode", "must be %s, %s or %s, found %q", DewManual, DewAuto, DewSchedule, d.Mode)
+		}
+		if d.Control != DewProportional && d.Control != DewPID {
+			add(field+".control", "must be %s or %s, found %q", DewProportional, DewPID, d.Control)
+		}
+		if d.Aggression < 1 || d.Aggression > 10 {
+			add(field+".aggression", "must be between 1 and 10, found %g", d.Aggression)
+		}
+		if d.Margin <= 0 {
+			add(field+".margin", "must be more than 0, found %g", d.Margin)
+		}
+		if d.Ki < 0 {
+			add(field+".ki", "must not be negative, found %g", d.Ki)
+		}
+		if d.Kd < 0 {
+			add(field+".kd", "must not be negative, found %g", d.Kd)
+		}
+	}
+	switch c.Weather.Type {
+	case WeatherNone:
+		if automatic {
+			add("weather.type", "a weather source is needed for dew heaters in %s mode", DewAuto)
+		}
+	case WeatherFile, WeatherHTTP:
+		if c.Weather.Path == "" {
+			add("weather.path", "must be set for a %s weather source", c.Weather.Type)
+		}
+		if c.Weather.Temperaturefield == "" {
+			add("weather.temperaturefield", "must not be empty")
+		}
+		if c.Weather.Humidityfield == "" {
+			add("weather.humidityfield", "must not be empty")
+		}
+	case WeatherAlpaca:
+		if c.Weather.Server == "" {
+			add("weather.server", "must be set for an alpaca weather source")
+		}
+	default:
+		add("weather.type", "must be one of %s, %s, %s or %s, found %q", WeatherNone, WeatherFile, WeatherHTTP, WeatherAlpaca, c.Weather.Type)
+	}
+	if c.Weather.Interval < 1 {
+		add("weather.interval", "must be at least 1 second, found %d", c.Weather.Interval)
+	}
+
+	if scheduled && !c.Dewschedule.hasSite() {
+		add("dewschedule.latitude", "latitude and longitude must be set for dew heaters in %s mode", DewSchedule)
+	}
+	if c.Dewschedule.Latitude < -90 || c.Dewschedule.Latitude > 90 {
+		add("dewschedule.latitude", "must be between -90 and 90, found %g", c.Dewschedule.Latitude)
+	}
+	if c.Dewschedule.Longitude < -180 || c.Dewschedule.Longitude > 180 {
+		add("dewschedule.longitude", "must be between -180 and 180, found %g", c.Dewschedule.Longitude)
+	}
+	if c.Dewschedule.Ramp < 0 {
+		add("dewschedule.ramp", "must not be negative, found %d", c.Dewschedule.Ramp)
+	}
+
+	c.validateInterlocks(add)
+	if c.Critical[0] {
+		add("critical[0]", "the focuser cannot be critical, only switches can")
+	}
+	if c.Confirmwindow < 1 {
+		add("confirmwindow", "must be at least 1 second, found %d", c.Confirmwindow)
+	}
+
+	for i, step := range c.Bootsequence {
+		if step.Id < 1 || step.Id > NumSwitches {
+			add(fmt.Sprintf("bootsequence[%d].id", i), "must be a switch number from 1 to %d, found %d", NumSwitches, step.Id)
+			continue
+		}
+		if step.Value < 0 || step.Value > c.Max[step.Id] {
+			add(fmt.Sprintf("bootsequence[%d].value", i), "must be between 0 and %d for %q, found %d", c.Max[step.Id], c.Name[step.Id], step.Value)
+		}
+		if step.Delay < 0 {
+			add(fmt.Sprintf("bootsequence[%d].delay", i), "must not be negative, found %d", step.Delay)
+		}
+	}
+	return
+}
+
+// Map each field path in a json document, e.g. "max[9]" or "bootsequence[0].id", to the offset just after it
+func jsonFieldOffsets(data []byte) map[string]int64 {
+	offsets := make(map[string]int64)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var value func(path string) bool
+	value = func(path string) bool {
+		tok, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		if _, seen := offsets[path]; !seen {
+			offsets[path] = dec.InputOffset()
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return false
+				}
+				p := strings.ToLower(fmt.Sprint(key))
+				if path != "" {
+					p = path + "." + p
+				}
+				offsets[p] = dec.InputOffset()
+				if !value(p) {
+					return false
+				}
+			}
+			_, err = dec.Token()
+			return err == nil
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if !value(fmt.Sprintf("%s[%d]", path, i)) {
+					return false
+				}
+			}
+			_, err = dec.Token()
+			return err == nil
+		}
+		return true
+	}
+	value("")
+	return offsets
+}
+
+// Convert a byte offset into a 1 based line and column
+func lineColumn(data []byte, offset int64) (line int, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n')
+	return
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Ambient temperature and humidity for the automatic dew heater control. They can be read
+// from a json file written by another program, a json document fetched over HTTP, or an
+// Alpaca ObservingConditions device such as a weather station driver.
+
+const (
+	WeatherNone   = "none"
+	WeatherFile   = "file"
+	WeatherHTTP   = "http"
+	WeatherAlpaca = "alpaca"
+)
+
+// Where a hub gets its weather from, the weather section of settings.json
+type weatherSource struct {
+	Type             string `json:"type"`             // none, file, http or alpaca
+	Path             string `json:"path"`             // file to read for file, URL to fetch for http
+	Temperaturefield string `json:"temperaturefield"` // field holding the temperature in °C, e.g. "main.temp"
+	Humidityfield    string `json:"humidityfield"`    // field holding the relative humidity in %
+	Server           string `json:"server"`           // host:port of the Alpaca server for alpaca
+	Device           uint32 `json:"device"`           // ObservingConditions device number for alpaca
+	Interval         int32  `json:"interval"`         // seconds between readings
+}
+
+func defaultWeatherSource() weatherSource {
+	return weatherSource{
+		Type:             WeatherNone,
+		Temperaturefield: "temperature",
+		Humidityfield:    "humidity",
+		Interval:         60,
+	}
+}
+
+type weatherReading struct {
+	Temperature float64 // °C
+	Humidity    float64 // relative humidity, %
+}
+
+// Reads the weather from a source. The Alpaca client is kept between readings.
+type weatherReader struct {
+	source weatherSource
+	alpaca *AlpacaClient
+}
+
+func (wr *weatherReader) read(source weatherSource) (reading weatherReading, err error) {
+	if source != wr.source {
+		wr.source = source
+		wr.alpaca = nil
+	}
+	switch source.Type {
+	case WeatherFile:
+		var data []byte
+		if data, err = os.ReadFile(source.Path); err != nil {
+			return
+		}
+		reading, err = parseWeather(data, source)
+	case WeatherHTTP:
+		reading, err = fetchWeather(source)
+	case WeatherAlpaca:
+		reading, err = wr.readAlpaca(source)
+	default:
+		return reading, errors.New("no weather source configured")
+	}
+	if err != nil {
+		return
+	}
+	if reading.Humidity <= 0 || reading.Humidity > 100 {
+		return reading, fmt.Errorf("humidity %.1f%% is out of range", reading.Humidity)
+	}
+	return
+}
+
+func fetchWeather(source weatherSource) (weatherReading, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(source.Path)
+	if err != nil {
+		return weatherReading{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return weatherReading{}, fmt.Errorf("%s returned %s", source.Path, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return weatherReading{}, err
+	}
+	return parseWeather(data, source)
+}
+
+func (wr *weatherReader) readAlpaca(source weatherSource) (reading weatherReading, err error) {
+	device := fmt.Sprintf("observingconditions/%d", source.Device)
+	if wr.alpaca == nil {
+		wr.alpaca = NewAlpacaClient(source.Server)
+		if err = wr.alpaca.Put(device, "connected", url.Values{"Connected": {"true"}}); err != nil {
+			wr.alpaca = nil
+			return
+		}
+	}
+	var temperature, humidity float64Response
+	if err = wr.alpaca.Get(device, "temperature", nil, &temperature); err == nil {
+		err = wr.alpaca.Get(device, "humidity", nil, &humidity)
+	}
+	if err != nil {
+		// Connect again next time in case the server was restarted
+		wr.alpaca = nil
+		return
+	}
+	return weatherReading{Temperature: temperature.Value, Humidity: humidity.Value}, nil
+}
+
+// Pick the temperature and humidity out of a json document
+func parseWeather(data []byte, source weatherSource) (reading weatherReading, err error) {
+	var doc any
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+	if reading.Temperature, err = jsonNumber(doc, source.Temperaturefield); err != nil {
+		return
+	}
+	reading.Humidity, err = jsonNumber(doc, source.Humidityfield)
+	return
+}
+
+// Look up a number by a dotted path such as "main.temp"
+func jsonNumber(doc any, path string) (float64, error) {
+	v := doc
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return 0, fmt.Errorf("field %q not found", path)
+		}
+		if v, ok = obj[key]; !ok {
+			return 0, fmt.Errorf("field %q not found", path)
+		}
+	}
+	n, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("field %q is not a number", path)
+	}
+	return n, nil
+}